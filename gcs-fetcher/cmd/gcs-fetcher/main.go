@@ -5,7 +5,7 @@ Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
 You may obtain a copy of the License at
 
-    http://www.apache.org/licenses/LICENSE-2.0
+	http://www.apache.org/licenses/LICENSE-2.0
 
 Unless required by applicable law or agreed to in writing, software
 distributed under the License is distributed on an "AS IS" BASIS,
@@ -17,12 +17,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
@@ -33,25 +37,89 @@ import (
 )
 
 const (
-	userAgent     = "gcs-fetcher"
+	userAgent = "gcs-fetcher"
 )
 
+// permissionDeniedExitStatus is the exit status when GCS denies access to a
+// file; all other failures exit with status 1.
+const permissionDeniedExitStatus = 3
+
+// driftExitStatus is the exit status when --verify finds that --dest_dir does
+// not match the manifest.
+const driftExitStatus = 4
+
+// interruptedExitStatus is the exit status when the fetch was interrupted by
+// a signal or ran out of its --deadline.
+const interruptedExitStatus = 5
+
 var (
-	sourceType = flag.String("type", "", "Type of source to fetch; one of Manifest, ZipArchive or TarGzArchive")
-	location   = flag.String("location", "", "Location of source to fetch; in the form gs://bucket/path/to/object#generation")
+	sourceType = flag.String("type", "", "Type of source to fetch; one of Manifest, ZipArchive, TarArchive, TarGzArchive, TarZstdArchive, TarXzArchive, TarBz2Archive or Auto to detect the archive type")
+	location   = flag.String("location", "", "Location of source to fetch; in the form gs://bucket/path/to/object#generation, file:///path/to/file, https://host/path/to/object or s3://bucket/path/to/object")
 
 	destDir     = flag.String("dest_dir", "", "The root where to write the files.")
 	workerCount = flag.Int("workers", 200, "The number of files to fetch in parallel.")
 	verbose     = flag.Bool("verbose", false, "If true, additional output is logged.")
 	retries     = flag.Int("retries", 3, "Number of times to retry a failed GCS download.")
 	backoff     = flag.Duration("backoff", 100*time.Millisecond, "Time to wait when retrying, will be doubled on each retry.")
+	maxBackoff  = flag.Duration("max_backoff", 30*time.Second, "The longest time to wait when retrying; 0 for no limit.")
 	timeoutGCS  = flag.Bool("timeout_gcs", true, "If true, a timeout will be used to avoid GCS longtails.")
+	deadline    = flag.Duration("deadline", 0, "If non-zero, the whole fetch is interrupted if it takes longer than this.")
 	help        = flag.Bool("help", false, "If true, prints help text and exits.")
 
+	maxBytesPerSecond = flag.Int64("max_bytes_per_second", 0, "If non-zero, limit the total rate of all downloads to this many bytes per second.")
+	maxPerBucket      = flag.Int("max_per_bucket", 0, "If non-zero, the largest number of files downloaded from each bucket at the same time.")
+
+	s3Endpoint = flag.String("s3_endpoint", "https://s3.amazonaws.com", "Base URL of the S3-compatible API that s3:// URLs are fetched from; credentials are taken from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN.")
+	s3Region   = flag.String("s3_region", "us-east-1", "Region that requests to --s3_endpoint are signed for.")
+
+	allowFileURLs = flag.Bool("allow_file_urls", false, "If true, manifests may name local files with file:// URLs; otherwise only a file:// --location may.")
+	allowHTTPURLs = flag.Bool("allow_http_urls", false, "If true, manifests may name objects with http:// and https:// URLs; otherwise only an --location of the same scheme may.")
+
+	billingProject    = flag.String("billing_project", "", "If set, the project billed for reading from GCS, which is required for requester-pays buckets.")
+	encryptionKeyFile = flag.String("encryption_key_file", "", "If set, a file holding the base64-encoded customer-supplied encryption key that GCS objects are encrypted with; objects that are not encrypted with one are read without it.")
+
+	unsupportedEntries = flag.String("unsupported_entries", fetcher.UnsupportedEntriesWarn, "How to handle archive entries that cannot be extracted, such as devices and fifos; one of error, warn or skip.")
+
+	maxExtractBytes     = flag.Int64("max_extract_bytes", 0, "If non-zero, fail if an archive expands to more than this many bytes.")
+	maxExtractEntries   = flag.Int("max_extract_entries", 0, "If non-zero, fail if an archive contains more than this many entries.")
+	maxCompressionRatio = flag.Float64("max_compression_ratio", 0, "If non-zero, fail if an archive expands to more than this many times its compressed size.")
+
+	sliceThreshold = flag.Int64("slice_threshold", 0, "If positive, archives of at least this many bytes are downloaded in slices, using up to --workers parallel ranged reads; 0 disables sliced downloads.")
+	stream         = flag.Bool("stream", false, "If true, tar-based archives are extracted while they are downloaded instead of being staged on disk and verified first; ignored with --keep_source.")
+
+	verify           = flag.Bool("verify", false, "If true, verify the files in --dest_dir against the --type=Manifest manifest instead of fetching them, reporting missing, extra, modified and wrong-mode files.")
+	requireChecksums = flag.Bool("require_checksums", false, "If true, fail files that cannot be verified against a checksum from the manifest or the object's metadata.")
+
+	cacheDir = flag.String("cache_dir", "", "If set, a local cache of manifest files keyed by their SHA1 checksum, e.g. on a persistent volume; files found there or already in --dest_dir are not downloaded again.")
+
+	progressInterval = flag.Duration("progress_interval", 0, "If non-zero, the time between progress lines with the files and bytes done, throughput, ETA, retries and slowest download in flight, which are added to the --report too.")
+
+	report     = flag.String("report", "", "If json, a JSON report of the fetch, with the attempts to download every file, is written to --report_file.")
+	reportFile = flag.String("report_file", "", "File to write the --report to; defaults to report.json in $BUILDER_OUTPUT if that is set.")
+
 	keepSource    = flag.Bool("keep_source", false, "If true, the source file is preserved in the file system.")
 	stagingFolder = flag.String("staging_folder", ".download/", "Temp folder where to download the source file.")
 )
 
+// stringsFlag is a flag that may be given multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+var include, exclude stringsFlag
+
+func init() {
+	flag.Var(&include, "include", "Only fetch the manifest or archive entries whose path matches this glob, in which ** matches any number of directories, e.g. services/foo/**; may be given multiple times.")
+	flag.Var(&exclude, "exclude", "Do not fetch the manifest or archive entries whose path matches this glob, in the form of --include; may be given multiple times.")
+}
+
 func logFatalf(writer io.Writer, format string, a ...interface{}) {
 	if _, err := fmt.Fprintf(writer, format+"\n", a...); err != nil {
 		log.Fatalf("Failed to write log: %v", err)
@@ -69,7 +137,8 @@ func main() {
 	}
 
 	var stdout, stderr io.Writer = os.Stdout, os.Stderr
-	if outputDir, ok := os.LookupEnv("BUILDER_OUTPUT"); ok {
+	outputDir, hasOutputDir := os.LookupEnv("BUILDER_OUTPUT")
+	if hasOutputDir {
 		if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
 			logFatalf(os.Stderr, "Failed to create folder %s: %v", outputDir, err)
 		}
@@ -90,22 +159,99 @@ func main() {
 		logFatalf(stderr, "Must specify --location and --type")
 	}
 
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx, option.WithUserAgent(userAgent))
-	if err != nil {
-		logFatalf(stderr, "Failed to create new GCS client: %v", err)
+	var reportWriter io.Writer
+	switch *report {
+	case "":
+	case "json":
+		name := *reportFile
+		if name == "" {
+			if !hasOutputDir {
+				logFatalf(stderr, "Must specify --report_file or set $BUILDER_OUTPUT with --report")
+			}
+			name = filepath.Join(outputDir, "report.json")
+		}
+		f, err := os.Create(name)
+		if err != nil {
+			logFatalf(stderr, "Cannot create report file %s: %v", name, err)
+		}
+		defer func() {
+			if cerr := f.Close(); cerr != nil {
+				log.Fatalf("Failed to close %q: %v", name, cerr)
+			}
+		}()
+		reportWriter = f
+	default:
+		logFatalf(stderr, "Unsupported --report %q, must be json", *report)
+	}
+
+	// Interrupt the fetch on SIGTERM and SIGINT, e.g. when the build is
+	// cancelled, so that it can clean up and write its report. A second
+	// signal terminates the process right away.
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		<-sigCtx.Done()
+		stop()
+	}()
+	ctx := sigCtx
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
 	}
 
-	bucket, object, generation, err := common.ParseBucketObject(*location)
+	bucket, object, generation, err := common.ParseSourceURL(*location)
 	if err != nil {
 		logFatalf(stderr, "Failed to parse --location: %v", err)
 	}
 
+	opts := common.ObjectOptions{BillingProject: *billingProject}
+	if *encryptionKeyFile != "" {
+		if opts.EncryptionKey, err = common.ReadEncryptionKey(*encryptionKeyFile); err != nil {
+			logFatalf(stderr, "Failed to read --encryption_key_file: %v", err)
+		}
+	}
+
+	backends := fetcher.Backends{
+		"s3": &fetcher.S3Backend{
+			Endpoint:        *s3Endpoint,
+			Region:          *s3Region,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+	// Manifests must not read local files or reach internal HTTP endpoints
+	// unless asked to; --location itself is trusted.
+	locationScheme := "gs"
+	if i := strings.Index(bucket, "://"); i >= 0 {
+		locationScheme = bucket[:i]
+	}
+	if *allowFileURLs || locationScheme == "file" {
+		backends["file"] = fetcher.FileBackend{}
+	}
+	for _, s := range []string{"http", "https"} {
+		if *allowHTTPURLs || locationScheme == s {
+			backends[s] = fetcher.HTTPBackend{}
+		}
+	}
+	// Fetches from the other backends do not need GCS credentials.
+	client, err := storage.NewClient(ctx, option.WithUserAgent(userAgent))
+	switch {
+	case err == nil:
+		backends["gs"] = realGCS{client, opts}
+	case !strings.Contains(bucket, "://"):
+		logFatalf(stderr, "Failed to create new GCS client: %v", err)
+	default:
+		fmt.Fprintf(stderr, "Failed to create new GCS client, gs:// URLs cannot be fetched: %v\n", err)
+	}
+
 	gcs := &fetcher.Fetcher{
-		GCS:         realGCS{client},
+		GCS:         backends,
 		OS:          realOS{},
 		DestDir:     *destDir,
 		StagingDir:  filepath.Join(*destDir, *stagingFolder),
+		CacheDir:    *cacheDir,
 		CreatedDirs: map[string]bool{},
 		Bucket:      bucket,
 		Object:      object,
@@ -114,13 +260,44 @@ func main() {
 		WorkerCount: *workerCount,
 		Retries:     *retries,
 		Backoff:     *backoff,
+		MaxBackoff:  *maxBackoff,
 		SourceType:  *sourceType,
 		KeepSource:  *keepSource,
 		Verbose:     *verbose,
 		Stdout:      stdout,
 		Stderr:      stderr,
+
+		UnsupportedEntries:  *unsupportedEntries,
+		MaxExtractBytes:     *maxExtractBytes,
+		MaxExtractEntries:   *maxExtractEntries,
+		MaxCompressionRatio: *maxCompressionRatio,
+		SliceThreshold:      *sliceThreshold,
+		Stream:              *stream,
+		RequireChecksums:    *requireChecksums,
+		Verify:              *verify,
+		MaxBytesPerSecond:   *maxBytesPerSecond,
+		MaxPerBucket:        *maxPerBucket,
+		ProgressInterval:    *progressInterval,
+		Include:             include,
+		Exclude:             exclude,
+		ReportWriter:        reportWriter,
 	}
 	if err := gcs.Fetch(ctx); err != nil {
+		var perr *fetcher.PermissionError
+		if errors.As(err, &perr) {
+			fmt.Fprintln(stderr, perr.Error())
+			os.Exit(permissionDeniedExitStatus)
+		}
+		var ierr *fetcher.InterruptedError
+		if errors.As(err, &ierr) {
+			fmt.Fprintln(stderr, err.Error())
+			os.Exit(interruptedExitStatus)
+		}
+		var derr *fetcher.DriftError
+		if errors.As(err, &derr) {
+			fmt.Fprintln(stderr, err.Error())
+			os.Exit(driftExitStatus)
+		}
 		logFatalf(stderr, "failed to Fetch: %v", err.Error())
 	}
 }
@@ -128,10 +305,58 @@ func main() {
 // realGCS is a wrapper over the GCS client functions.
 type realGCS struct {
 	client *storage.Client
+	opts   common.ObjectOptions
 }
 
-func (gp realGCS) NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, error) {
-	return gp.client.Bucket(bucket).Object(object).NewReader(ctx)
+func (gp realGCS) object(bucket, object string, generation int64) *storage.ObjectHandle {
+	obj := gp.opts.Object(gp.client, bucket, object)
+	if generation > 0 {
+		obj = obj.Generation(generation)
+	}
+	return obj
+}
+
+// withoutKey returns gp without its encryption key if err shows that the
+// object is not encrypted with one, so that the request can be repeated
+// without it; manifests may mix encrypted and unencrypted objects.
+func (gp realGCS) withoutKey(err error) (realGCS, bool) {
+	if len(gp.opts.EncryptionKey) == 0 || !common.IsNotEncrypted(err) {
+		return gp, false
+	}
+	gp.opts.EncryptionKey = nil
+	return gp, true
+}
+
+func (gp realGCS) NewReader(ctx context.Context, bucket, object string, generation int64) (io.ReadCloser, error) {
+	r, err := gp.object(bucket, object, generation).NewReader(ctx)
+	if plain, ok := gp.withoutKey(err); ok {
+		return plain.NewReader(ctx, bucket, object, generation)
+	}
+	return r, err
+}
+
+func (gp realGCS) NewRangeReader(ctx context.Context, bucket, object string, generation, offset, length int64) (io.ReadCloser, error) {
+	r, err := gp.object(bucket, object, generation).NewRangeReader(ctx, offset, length)
+	if plain, ok := gp.withoutKey(err); ok {
+		return plain.NewRangeReader(ctx, bucket, object, generation, offset, length)
+	}
+	return r, err
+}
+
+func (gp realGCS) Attrs(ctx context.Context, bucket, object string, generation int64) (*fetcher.ObjectAttrs, error) {
+	attrs, err := gp.object(bucket, object, generation).Attrs(ctx)
+	if plain, ok := gp.withoutKey(err); ok {
+		return plain.Attrs(ctx, bucket, object, generation)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fetcher.ObjectAttrs{
+		Size:       attrs.Size,
+		Generation: attrs.Generation,
+		CRC32C:     attrs.CRC32C,
+		MD5:        attrs.MD5,
+	}, nil
 }
 
 // realOS merely wraps the os package implementations.
@@ -157,6 +382,14 @@ func (realOS) Open(name string) (*os.File, error) {
 	return os.Open(name)
 }
 
+func (realOS) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
 func (realOS) RemoveAll(path string) error {
 	return os.RemoveAll(path)
 }
+
+func (realOS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
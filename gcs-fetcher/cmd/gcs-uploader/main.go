@@ -19,7 +19,6 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -35,9 +34,12 @@ const userAgent = "gcs-uploader"
 
 var (
 	dir         = flag.String("dir", ".", "Directory of files to upload")
-	location    = flag.String("location", "", "Location of manifest file to upload; in the form gs://bucket/path/to/object")
+	location    = flag.String("location", "", "Location of manifest file to upload; in the form gs://bucket/path/to/object. Manifests named *.gz are gzip compressed.")
 	workerCount = flag.Int("workers", 200, "The number of files to upload in parallel.")
 	help        = flag.Bool("help", false, "If true, prints help text and exits.")
+
+	billingProject    = flag.String("billing_project", "", "If set, the project billed for writing to GCS, which is required for requester-pays buckets.")
+	encryptionKeyFile = flag.String("encryption_key_file", "", "If set, a file holding the base64-encoded customer-supplied encryption key to encrypt the uploaded objects with.")
 )
 
 func main() {
@@ -60,13 +62,20 @@ func main() {
 		log.Fatalln("cannot specify manifest file generation")
 	}
 
+	opts := common.ObjectOptions{BillingProject: *billingProject}
+	if *encryptionKeyFile != "" {
+		if opts.EncryptionKey, err = common.ReadEncryptionKey(*encryptionKeyFile); err != nil {
+			log.Fatalf("Failed to read --encryption_key_file: %v", err)
+		}
+	}
+
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx, option.WithUserAgent(userAgent))
 	if err != nil {
 		log.Fatalf("Failed to create new GCS client: %v", err)
 	}
 
-	u := uploader.New(ctx, realGCS{client}, realOS{}, bucket, object, *workerCount)
+	u := uploader.New(ctx, realGCS{client, opts}, realOS{}, bucket, object, *workerCount)
 
 	filepath.Walk(*dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -88,10 +97,11 @@ func main() {
 // realGCS is a wrapper over the GCS client functions.
 type realGCS struct {
 	client *storage.Client
+	opts   common.ObjectOptions
 }
 
-func (gp realGCS) NewWriter(ctx context.Context, bucket, object string) io.WriteCloser {
-	return gp.client.Bucket(bucket).Object(object).
+func (gp realGCS) NewWriter(ctx context.Context, bucket, object string) uploader.Writer {
+	return gp.opts.Object(gp.client, bucket, object).
 		If(storage.Conditions{DoesNotExist: true}). // Skip upload if already exists.
 		NewWriter(ctx)
 }
@@ -2,6 +2,9 @@ module github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher
 
 require (
 	cloud.google.com/go/storage v1.62.1
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/time v0.15.0
 	google.golang.org/api v0.276.0
 )
 
@@ -50,7 +53,6 @@ require (
 	golang.org/x/sync v0.20.0 // indirect
 	golang.org/x/sys v0.43.0 // indirect
 	golang.org/x/text v0.36.0 // indirect
-	golang.org/x/time v0.15.0 // indirect
 	golang.org/x/xerrors v0.0.0-20231012003039-104605ab7028 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
 	google.golang.org/genproto v0.0.0-20260420184626-e10c466a9529 // indirect
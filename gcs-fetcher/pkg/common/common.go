@@ -20,6 +20,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ManifestItem describes an item in the source manifest.
@@ -30,9 +31,20 @@ type ManifestItem struct {
 	// Sha1Sum is the SHA1 digest of the object.
 	Sha1Sum string `json:"sha1sum"`
 
+	// Sha256Sum is the SHA256 digest of the object, if recorded.
+	Sha256Sum string `json:"sha256,omitempty"`
+
 	// FileMode is the mode of the file that should be applied to the
-	// fetched file.
+	// fetched file. Manifests written before modes were recorded leave this
+	// unset, in which case the fetcher applies a default mode.
 	FileMode os.FileMode `json:"mode"`
+
+	// ModTime is the modification time of the file, if recorded.
+	ModTime *time.Time `json:"mtime,omitempty"`
+
+	// Size is the size of the object in bytes, if recorded. The fetcher
+	// derives its timeouts from it.
+	Size int64 `json:"size,omitempty"`
 }
 
 // ParseBucketObject parses a URI into the bucket and object name it points to.
@@ -71,6 +83,48 @@ func ParseBucketObject(uri string) (bucket, object string, generation int64, err
 	return "", "", 0, fmt.Errorf("cannot parse bucket/object from uri %q", uri)
 }
 
+// ParseSourceURL parses the URL of an object in any of the storage backends
+// that the fetcher supports into the bucket, object and generation it points
+// to. GCS URLs are parsed by ParseBucketObject. For the other backends, bucket
+// is the scheme and host of the URL, object is the rest of it, and there is
+// no generation:
+// - file:///path/to/file
+// - https://example.com/path/to/object
+// - s3://bucket/path/to/object
+//
+// In the above cases bucket=file://, https://example.com and s3://bucket
+// respectively, and object=path/to/file or path/to/object.
+func ParseSourceURL(uri string) (bucket, object string, generation int64, err error) {
+	if strings.HasPrefix(uri, "gs://") || strings.HasPrefix(uri, "https://storage.googleapis.com/") || strings.HasPrefix(uri, "http://storage.googleapis.com/") {
+		return ParseBucketObject(uri)
+	}
+	i := strings.Index(uri, "://")
+	if i < 0 {
+		return "", "", 0, fmt.Errorf("cannot parse bucket/object from uri %q", uri)
+	}
+	scheme, rest := uri[:i], uri[i+3:]
+	j := strings.Index(rest, "/")
+	if j < 0 || j == len(rest)-1 {
+		return "", "", 0, fmt.Errorf("cannot parse bucket/object from uri %q", uri)
+	}
+	host, object := rest[:j], rest[j+1:]
+	switch scheme {
+	case "file":
+		// Only local files are supported, e.g. file:///path/to/file.
+		if host != "" && host != "localhost" {
+			return "", "", 0, fmt.Errorf("cannot parse file path from uri %q, host must be empty or localhost", uri)
+		}
+		host = ""
+	case "http", "https", "s3":
+		if host == "" {
+			return "", "", 0, fmt.Errorf("cannot parse bucket/object from uri %q", uri)
+		}
+	default:
+		return "", "", 0, fmt.Errorf("unsupported scheme %q in uri %q", scheme, uri)
+	}
+	return scheme + "://" + host, object, 0, nil
+}
+
 func splitObjectAndGeneration(fullObject string) (object string, generation int64, err error) {
 	generation = 0
 	object = fullObject
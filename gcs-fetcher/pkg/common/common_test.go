@@ -16,7 +16,14 @@ limitations under the License.
 package common
 
 import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"google.golang.org/api/googleapi"
 )
 
 func TestParseBucketObject(t *testing.T) {
@@ -108,3 +115,127 @@ func TestParseBucketObject(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSourceURL(t *testing.T) {
+	for _, c := range []struct {
+		uri        string
+		bucket     string
+		object     string
+		generation int64
+		wantErr    bool
+	}{{
+		uri:        "gs://some-bucket/abc123#4444",
+		bucket:     "some-bucket",
+		object:     "abc123",
+		generation: 4444,
+	}, {
+		uri:    "https://storage.googleapis.com/some-bucket/abc123",
+		bucket: "some-bucket",
+		object: "abc123",
+	}, {
+		uri:    "file:///path/to/file",
+		bucket: "file://",
+		object: "path/to/file",
+	}, {
+		uri:    "file://localhost/path/to/file",
+		bucket: "file://",
+		object: "path/to/file",
+	}, {
+		uri:    "https://example.com:8443/path/to/object?token=abc",
+		bucket: "https://example.com:8443",
+		object: "path/to/object?token=abc",
+	}, {
+		uri:    "http://example.com/object#1234",
+		bucket: "http://example.com",
+		object: "object#1234",
+	}, {
+		uri:    "s3://my-bucket/path/to/object",
+		bucket: "s3://my-bucket",
+		object: "path/to/object",
+	}, {
+		uri:     "file://remote-host/path/to/file",
+		wantErr: true,
+	}, {
+		uri:     "https://example.com/",
+		wantErr: true,
+	}, {
+		uri:     "s3:///path/to/object",
+		wantErr: true,
+	}, {
+		uri:     "ftp://example.com/path/to/object",
+		wantErr: true,
+	}, {
+		uri:     "some-bucket/some/path",
+		wantErr: true,
+	}} {
+		bucket, object, generation, err := ParseSourceURL(c.uri)
+		if (err != nil) != c.wantErr {
+			t.Errorf("ParseSourceURL(%q): got %v, wantErr = %t", c.uri, err, c.wantErr)
+		}
+		if err == nil {
+			if bucket != c.bucket || object != c.object || generation != c.generation {
+				t.Errorf("ParseSourceURL(%q) = (%q, %q, %d); want (%q, %q, %d)", c.uri, bucket, object, generation, c.bucket, c.object, c.generation)
+			}
+		}
+	}
+}
+
+func TestReadEncryptionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "common")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, c := range []struct {
+		contents string
+		wantErr  bool
+	}{
+		{contents: base64.StdEncoding.EncodeToString(key) + "\n"},
+		{contents: string(key)},
+		{contents: "c2hvcnQga2V5", wantErr: true},
+		{contents: "", wantErr: true},
+	} {
+		name := filepath.Join(dir, "key")
+		if err := ioutil.WriteFile(name, []byte(c.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadEncryptionKey(name)
+		if (err != nil) != c.wantErr {
+			t.Errorf("ReadEncryptionKey(%q): got %v, wantErr = %t", c.contents, err, c.wantErr)
+		}
+		if err == nil && string(got) != string(key) {
+			t.Errorf("ReadEncryptionKey(%q) = %q; want %q", c.contents, got, key)
+		}
+	}
+}
+
+func TestGCSErrors(t *testing.T) {
+	userProjectMissing := &googleapi.Error{Code: 400, Message: "Bucket is a requester pays bucket but no user project provided."}
+	keyMissingXML := &googleapi.Error{Code: 400, Body: "<Error><Code>ResourceIsEncryptedWithCustomerEncryptionKey</Code></Error>"}
+	keyIncorrect := &googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "customerEncryptionKeySha256IsInvalid"}}}
+	notEncrypted := &googleapi.Error{Code: 400, Message: "The target object is not encrypted by a customer-supplied encryption key."}
+	for _, c := range []struct {
+		name string
+		is   func(error) bool
+		yes  []error
+		no   []error
+	}{
+		{"IsUserProjectMissing", IsUserProjectMissing, []error{userProjectMissing, fmt.Errorf("reading: %w", userProjectMissing)}, []error{keyMissingXML, &googleapi.Error{Code: 403}, nil}},
+		{"IsEncryptionKeyMissing", IsEncryptionKeyMissing, []error{keyMissingXML}, []error{notEncrypted, keyIncorrect, nil}},
+		{"IsEncryptionKeyIncorrect", IsEncryptionKeyIncorrect, []error{keyIncorrect}, []error{keyMissingXML, notEncrypted}},
+		{"IsNotEncrypted", IsNotEncrypted, []error{notEncrypted}, []error{keyMissingXML, keyIncorrect}},
+	} {
+		for _, err := range c.yes {
+			if !c.is(err) {
+				t.Errorf("%s(%v) = false; want true", c.name, err)
+			}
+		}
+		for _, err := range c.no {
+			if c.is(err) {
+				t.Errorf("%s(%v) = true; want false", c.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package common
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// ObjectOptions are the options of the requests that the fetcher and the
+// uploader make for GCS objects.
+type ObjectOptions struct {
+	// BillingProject is the project billed for requests, which is required
+	// for requester-pays buckets. Empty means the bucket's project.
+	BillingProject string
+
+	// EncryptionKey is the AES-256 customer-supplied encryption key (CSEK)
+	// that objects are encrypted with. Empty means Google-managed keys.
+	EncryptionKey []byte
+}
+
+// Object returns the handle of the object, with the options applied.
+func (o ObjectOptions) Object(client *storage.Client, bucket, object string) *storage.ObjectHandle {
+	b := client.Bucket(bucket)
+	if o.BillingProject != "" {
+		b = b.UserProject(o.BillingProject)
+	}
+	obj := b.Object(object)
+	if len(o.EncryptionKey) > 0 {
+		obj = obj.Key(o.EncryptionKey)
+	}
+	return obj
+}
+
+// ReadEncryptionKey reads a customer-supplied encryption key from a file,
+// which holds either the base64-encoded key, as gsutil takes it, or the 32
+// bytes of the key themselves.
+func ReadEncryptionKey(name string) ([]byte, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b))); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	return nil, fmt.Errorf("%s does not hold a 256-bit key, either base64-encoded or raw", name)
+}
+
+// errorText returns the lowercased message, body and reasons of err, if it
+// is a GCS error.
+func errorText(err error) (string, bool) {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return "", false
+	}
+	text := []string{gerr.Message, gerr.Body}
+	for _, item := range gerr.Errors {
+		text = append(text, item.Reason, item.Message)
+	}
+	return strings.ToLower(strings.Join(text, " ")), true
+}
+
+// gcsErrorContains reports whether err is a GCS error that mentions any of
+// the lowercase substrings, as either the JSON or the XML API words it.
+func gcsErrorContains(err error, substrings ...string) bool {
+	text, ok := errorText(err)
+	if !ok {
+		return false
+	}
+	for _, s := range substrings {
+		if strings.Contains(text, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUserProjectMissing reports whether err is the error of a request to a
+// requester-pays bucket that did not name a project to bill.
+func IsUserProjectMissing(err error) bool {
+	return gcsErrorContains(err, "userprojectmissing", "no user project provided")
+}
+
+// IsEncryptionKeyMissing reports whether err is the error of a request for
+// an object encrypted with a customer-supplied encryption key that did not
+// supply it.
+func IsEncryptionKeyMissing(err error) bool {
+	return gcsErrorContains(err, "resourceisencryptedwithcustomerencryptionkey", "is encrypted by a customer-supplied encryption key")
+}
+
+// IsEncryptionKeyIncorrect reports whether err is the error of a request
+// that supplied the wrong customer-supplied encryption key for an object.
+func IsEncryptionKeyIncorrect(err error) bool {
+	return gcsErrorContains(err, "customerencryptionkeyisincorrect", "customerencryptionkeysha256isinvalid", "encryption key is incorrect")
+}
+
+// IsNotEncrypted reports whether err is the error of a request that supplied
+// a customer-supplied encryption key for an object that is not encrypted
+// with one.
+func IsNotEncrypted(err error) bool {
+	return gcsErrorContains(err, "resourcenotencryptedwithcustomerencryptionkey", "not encrypted by a customer-supplied encryption key")
+}
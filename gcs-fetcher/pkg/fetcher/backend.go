@@ -0,0 +1,299 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// errNoGenerations is returned by backends whose objects have no
+// generations when asked for a specific one.
+var errNoGenerations = errors.New("generations are only supported for GCS objects")
+
+// Backends is a GCS that serves objects from several storage backends, keyed
+// by the scheme of their URLs, e.g. "gs", "file", "https" or "s3". Buckets are
+// named as by common.ParseSourceURL: plain bucket names are GCS buckets, and
+// the buckets of the other backends carry the scheme of their URL, e.g.
+// "https://example.com". Every backend is passed the bucket as it is.
+//
+// Backends may implement AttrsGCS and RangeGCS, in which case their
+// downloads are verified and sliced like those from GCS.
+type Backends map[string]GCS
+
+// scheme returns the scheme of the URLs of objects in bucket.
+func scheme(bucket string) string {
+	if i := strings.Index(bucket, "://"); i >= 0 {
+		return bucket[:i]
+	}
+	return "gs"
+}
+
+// NewReader returns a reader from the backend of bucket.
+func (b Backends) NewReader(ctx context.Context, bucket, object string, generation int64) (io.ReadCloser, error) {
+	g, ok := b[scheme(bucket)]
+	if !ok {
+		return nil, fmt.Errorf("no backend for %s:// URLs", scheme(bucket))
+	}
+	return g.NewReader(ctx, bucket, object, generation)
+}
+
+// backend returns the GCS that serves the objects in bucket, or an error if
+// there is none.
+func (gf *Fetcher) backend(bucket string) (GCS, error) {
+	s := scheme(bucket)
+	b, ok := gf.GCS.(Backends)
+	if !ok {
+		if s != "gs" {
+			return nil, fmt.Errorf("no backend for %s:// URLs", s)
+		}
+		return gf.GCS, nil
+	}
+	g, ok := b[s]
+	if !ok {
+		var schemes []string
+		for k := range b {
+			schemes = append(schemes, k+"://")
+		}
+		sort.Strings(schemes)
+		return nil, fmt.Errorf("no backend for %s:// URLs, only for %s", s, strings.Join(schemes, ", "))
+	}
+	return g, nil
+}
+
+// statusError is returned by the HTTP-based backends for responses with an
+// unexpected status. Like GCS errors, it is classified by its status code.
+type statusError struct {
+	method, url string
+	code        int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.method, e.url, e.code, http.StatusText(e.code))
+}
+
+// httpStatus returns the HTTP status code of err, if it is the error of a
+// GCS or HTTP request.
+func httpStatus(err error) (int, bool) {
+	var (
+		gerr *googleapi.Error
+		serr *statusError
+	)
+	switch {
+	case errors.As(err, &gerr):
+		return gerr.Code, true
+	case errors.As(err, &serr):
+		return serr.code, true
+	}
+	return 0, false
+}
+
+// FileBackend serves the objects of file:// URLs from the local file system.
+type FileBackend struct{}
+
+func (FileBackend) path(object string) string {
+	return filepath.FromSlash("/" + object)
+}
+
+// NewReader returns a reader for the file.
+func (fb FileBackend) NewReader(ctx context.Context, bucket, object string, generation int64) (io.ReadCloser, error) {
+	if generation != 0 {
+		return nil, errNoGenerations
+	}
+	return os.Open(fb.path(object))
+}
+
+// NewRangeReader returns a reader for length bytes of the file, starting at
+// offset.
+func (fb FileBackend) NewRangeReader(ctx context.Context, bucket, object string, generation, offset, length int64) (io.ReadCloser, error) {
+	if generation != 0 {
+		return nil, errNoGenerations
+	}
+	f, err := os.Open(fb.path(object))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+// Attrs returns the size of the file. Files have no checksums.
+func (fb FileBackend) Attrs(ctx context.Context, bucket, object string, generation int64) (*ObjectAttrs, error) {
+	if generation != 0 {
+		return nil, errNoGenerations
+	}
+	fi, err := os.Stat(fb.path(object))
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", fb.path(object))
+	}
+	return &ObjectAttrs{Size: fi.Size(), NoCRC32C: true}, nil
+}
+
+// HTTPBackend serves the objects of http:// and https:// URLs with plain GET
+// requests. Ranges are read with Range requests, and the attributes of
+// objects are taken from the response to a HEAD request.
+type HTTPBackend struct {
+	// Client makes the requests; nil means http.DefaultClient.
+	Client *http.Client
+}
+
+func (hb HTTPBackend) url(bucket, object string) string {
+	return bucket + "/" + object
+}
+
+// NewReader returns a reader for the object.
+func (hb HTTPBackend) NewReader(ctx context.Context, bucket, object string, generation int64) (io.ReadCloser, error) {
+	return hb.NewRangeReader(ctx, bucket, object, generation, 0, -1)
+}
+
+// NewRangeReader returns a reader for length bytes of the object, starting at
+// offset; a negative length reads to the end of the object.
+func (hb HTTPBackend) NewRangeReader(ctx context.Context, bucket, object string, generation, offset, length int64) (io.ReadCloser, error) {
+	if generation != 0 {
+		return nil, errNoGenerations
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hb.url(bucket, object), nil)
+	if err != nil {
+		return nil, err
+	}
+	return getRange(hb.Client, req, nil, offset, length)
+}
+
+// Attrs returns the size of the object, and its checksums if the server
+// sends them in an X-Goog-Hash header, as GCS and its mirrors do.
+func (hb HTTPBackend) Attrs(ctx context.Context, bucket, object string, generation int64) (*ObjectAttrs, error) {
+	if generation != 0 {
+		return nil, errNoGenerations
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, hb.url(bucket, object), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := do(hb.Client, req, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return httpAttrs(resp)
+}
+
+// do sends req, signed by sign if it is not nil, and returns the response if
+// it has the status want. Other responses are closed and returned as a
+// statusError.
+func do(client *http.Client, req *http.Request, sign func(*http.Request), want ...int) (*http.Response, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if sign != nil {
+		sign(req)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range want {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	return nil, &statusError{method: req.Method, url: req.URL.Redacted(), code: resp.StatusCode}
+}
+
+// getRange sends the GET request req for length bytes starting at offset,
+// or for the whole object if length is negative. If the server ignores the
+// Range header, the bytes outside the range are skipped.
+func getRange(client *http.Client, req *http.Request, sign func(*http.Request), offset, length int64) (io.ReadCloser, error) {
+	ranged := offset > 0 || length >= 0
+	if ranged {
+		if length >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+	}
+	resp, err := do(client, req, sign, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+	if !ranged || resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, nil
+	}
+	if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("skipping to offset %d of %s: %w", offset, req.URL.Redacted(), err)
+	}
+	var r io.Reader = resp.Body
+	if length >= 0 {
+		r = io.LimitReader(r, length)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, resp.Body}, nil
+}
+
+// httpAttrs returns the attributes of the object of a response to a HEAD
+// request.
+func httpAttrs(resp *http.Response) (*ObjectAttrs, error) {
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("%s %s: no Content-Length", resp.Request.Method, resp.Request.URL.Redacted())
+	}
+	attrs := &ObjectAttrs{Size: resp.ContentLength, NoCRC32C: true}
+	for _, h := range resp.Header.Values("X-Goog-Hash") {
+		for _, v := range strings.Split(h, ",") {
+			v = strings.TrimSpace(v)
+			switch {
+			case strings.HasPrefix(v, "crc32c="):
+				if crc, ok := decodeCRC32C(strings.TrimPrefix(v, "crc32c=")); ok {
+					attrs.CRC32C, attrs.NoCRC32C = crc, false
+				}
+			case strings.HasPrefix(v, "md5="):
+				if md5, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, "md5=")); err == nil && len(md5) == 16 {
+					attrs.MD5 = md5
+				}
+			}
+		}
+	}
+	return attrs, nil
+}
+
+// decodeCRC32C decodes a base64-encoded, big-endian CRC32C checksum.
+func decodeCRC32C(s string) (uint32, bool) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b), true
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const backendContents = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// backendServer serves backendContents at /object, and the given status at
+// every other path.
+func backendServer(t *testing.T, status int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/object" {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("X-Goog-Hash", fmt.Sprintf("crc32c=%s", crc32cBase64(backendContents)))
+		http.ServeContent(w, r, "object", time.Time{}, strings.NewReader(backendContents))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func crc32cBase64(s string) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, crc32.Checksum([]byte(s), crc32cTable))
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestFormatGCSName(t *testing.T) {
+	for _, c := range []struct {
+		bucket, object string
+		generation     int64
+		want           string
+	}{
+		{"bucket", "path/to/object", 0, "gs://bucket/path/to/object"},
+		{"bucket", "object", 1234, "gs://bucket/object#1234"},
+		{"file://", "path/to/file", 0, "file:///path/to/file"},
+		{"https://example.com", "path/to/object", 0, "https://example.com/path/to/object"},
+		{"s3://bucket", "object", 0, "s3://bucket/object"},
+	} {
+		if got := formatGCSName(c.bucket, c.object, c.generation); got != c.want {
+			t.Errorf("formatGCSName(%q, %q, %d) got %q, want %q", c.bucket, c.object, c.generation, got, c.want)
+		}
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte(backendContents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	object := strings.TrimPrefix(filepath.ToSlash(name), "/")
+
+	ctx := context.Background()
+	var fb FileBackend
+	r, err := fb.NewRangeReader(ctx, "file://", object, 0, 10, 5)
+	if err != nil {
+		t.Fatalf("NewRangeReader() got %v, want nil", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != backendContents[10:15] {
+		t.Errorf("NewRangeReader() read %q (%v), want %q", got, err, backendContents[10:15])
+	}
+	attrs, err := fb.Attrs(ctx, "file://", object, 0)
+	if err != nil || attrs.Size != int64(len(backendContents)) || !attrs.NoCRC32C {
+		t.Errorf("Attrs() got %+v (%v), want size %d without CRC32C", attrs, err, len(backendContents))
+	}
+	if _, err := fb.NewReader(ctx, "file://", object+"-missing", 0); !isNotFound(err) {
+		t.Errorf("NewReader() of a missing file got %v, want not found", err)
+	}
+}
+
+func TestHTTPBackend(t *testing.T) {
+	srv := backendServer(t, http.StatusNotFound)
+	hb := HTTPBackend{Client: srv.Client()}
+	ctx := context.Background()
+
+	r, err := hb.NewRangeReader(ctx, srv.URL, "object", 0, 10, 5)
+	if err != nil {
+		t.Fatalf("NewRangeReader() got %v, want nil", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != backendContents[10:15] {
+		t.Errorf("NewRangeReader() read %q (%v), want %q", got, err, backendContents[10:15])
+	}
+
+	attrs, err := hb.Attrs(ctx, srv.URL, "object", 0)
+	if err != nil {
+		t.Fatalf("Attrs() got %v, want nil", err)
+	}
+	if want := crc32.Checksum([]byte(backendContents), crc32cTable); attrs.Size != int64(len(backendContents)) || attrs.NoCRC32C || attrs.CRC32C != want {
+		t.Errorf("Attrs() got %+v, want size %d and CRC32C %08x", attrs, len(backendContents), want)
+	}
+
+	_, err = hb.NewReader(ctx, srv.URL, "missing", 0)
+	if !isNotFound(err) || classify(err) != permanentError {
+		t.Errorf("NewReader() of a missing object got %v, want a permanent not found error", err)
+	}
+}
+
+func TestGetRangeIgnoredByServer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(backendContents))
+	}))
+	defer srv.Close()
+
+	r, err := HTTPBackend{}.NewRangeReader(context.Background(), srv.URL, "object", 0, 10, 5)
+	if err != nil {
+		t.Fatalf("NewRangeReader() got %v, want nil", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != backendContents[10:15] {
+		t.Errorf("NewRangeReader() read %q (%v), want %q", got, err, backendContents[10:15])
+	}
+}
+
+func TestBackendsMixedManifest(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	srv := backendServer(t, http.StatusForbidden)
+	local := filepath.Join(tc.workDir, "local")
+	if err := ioutil.WriteFile(local, []byte(backendContents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := fmt.Sprintf(`{
+		"from-gcs":  {"sourceUrl": "gs://%s/%s"},
+		"from-file": {"sourceUrl": "file://%s"},
+		"from-http": {"sourceUrl": "%s/object"}
+	}`, successBucket, sfile1, filepath.ToSlash(local), srv.URL)
+	tc.gcs.objects[formatGCSName(successBucket, "mixed.json", generation)] = fakeGCSResponse{content: []byte(manifest)}
+	tc.gf.Object = "mixed.json"
+	tc.gf.GCS = Backends{
+		"gs":   tc.gcs,
+		"file": FileBackend{},
+		"http": HTTPBackend{Client: srv.Client()},
+	}
+
+	if err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+		t.Fatalf("fetchFromManifest() got %v, want nil", err)
+	}
+	for name, want := range map[string][]byte{
+		"from-gcs":  sfile1Contents,
+		"from-file": []byte(backendContents),
+		"from-http": []byte(backendContents),
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(tc.workDir, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("fetchFromManifest() wrote %s %q (%v), want %q", name, got, err, want)
+		}
+	}
+
+	// Access to HTTP objects is denied like to GCS objects, but there is no
+	// robot to grant access to.
+	j := job{filename: "denied", bucket: srv.URL, object: "denied"}
+	report := tc.gf.fetchObject(context.Background(), j)
+	var perr *PermissionError
+	if !errors.As(report.err, &perr) || perr.Robot != "" {
+		t.Errorf("fetchObject(%s) got %v, want PermissionError without a robot", formatGCSName(j.bucket, j.object, 0), report.err)
+	}
+}
+
+func TestFetchFromArchiveRequireChecksumsHTTP(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	// The server sends no X-Goog-Hash, so the archive has no checksum.
+	archive := buildArchive(t, "TarGzArchive")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "source.tar.gz", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer srv.Close()
+	tc.gf.GCS = Backends{"http": HTTPBackend{Client: srv.Client()}}
+	tc.gf.Bucket = srv.URL
+	tc.gf.Object = "source.tar.gz"
+	tc.gf.SourceType = "TarGzArchive"
+	tc.gf.RequireChecksums = true
+	for _, c := range []struct {
+		stream         bool
+		sliceThreshold int64
+	}{{false, 0}, {true, 0}, {false, 1}} {
+		tc.gf.Stream, tc.gf.SliceThreshold = c.stream, c.sliceThreshold
+		err := tc.gf.Fetch(context.Background())
+		var uerr *UnverifiableError
+		if !errors.As(err, &uerr) {
+			t.Errorf("Fetch() with %+v got %v, want UnverifiableError", c, err)
+		}
+		if got := listFiles(t, tc.gf.DestDir); len(got) != 0 {
+			t.Errorf("files after Fetch() with %+v got %v, want none", c, got)
+		}
+	}
+}
+
+func TestBackendsUnsupportedScheme(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	manifest := []byte(`{"f": {"sourceUrl": "s3://bucket/object"}}`)
+	tc.gcs.objects[formatGCSName(successBucket, "s3.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gf.Object = "s3.json"
+	tc.gf.GCS = Backends{"gs": tc.gcs}
+	err := tc.gf.fetchFromManifest(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no backend for s3:// URLs") {
+		t.Errorf("fetchFromManifest() got %v, want no backend error", err)
+	}
+
+	// A plain GCS only serves gs:// URLs.
+	tc.gf.GCS = tc.gcs
+	tc.gf.Bucket = "https://example.com"
+	if err := tc.gf.fetch(context.Background()); err == nil || !strings.Contains(err.Error(), "no backend for https:// URLs") {
+		t.Errorf("fetch() got %v, want no backend error", err)
+	}
+}
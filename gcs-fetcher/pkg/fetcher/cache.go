@@ -0,0 +1,263 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// normalizeHex returns the checksum sum as lowercase hex digits, the form
+// used to compare checksums and to key the cache.
+func normalizeHex(sum string) string {
+	return nonHexRegex.ReplaceAllString(strings.ToLower(sum), "")
+}
+
+// hashFile returns the lowercase hex SHA1 checksum and the size of the file
+// name.
+func hashFile(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), n, nil
+}
+
+// hasAttrs reports whether the regular file described by fi has the mode and
+// modification time that job j restores.
+func hasAttrs(fi os.FileInfo, j job) bool {
+	if !fi.Mode().IsRegular() || fi.Mode()&restorableModeBits != j.fileMode() {
+		return false
+	}
+	return j.mtime.IsZero() || fi.ModTime().Equal(j.mtime)
+}
+
+// cachePath returns the path of the blob with the given normalized SHA1
+// checksum in the local cache.
+func (gf *Fetcher) cachePath(sha string) string {
+	return filepath.Join(gf.CacheDir, sha[:2], sha)
+}
+
+// fetchLocal tries to satisfy job j without GCS, from a file already present
+// at the destination or from the local cache, both of which are only trusted
+// after their SHA1 checksum has been verified. It returns nil if neither has
+// the file, in which case it must be fetched from GCS.
+func (gf *Fetcher) fetchLocal(j job) *jobReport {
+	sha := normalizeHex(j.sha1sum)
+	if len(sha) != 2*sha1.Size {
+		return nil
+	}
+	started := time.Now()
+	finalname := filepath.Join(gf.DestDir, j.filename)
+	report := &jobReport{job: j, started: started}
+
+	// A previous fetch into the same destination may have left the file
+	// exactly as it should be.
+	if fi, err := os.Lstat(finalname); err == nil && hasAttrs(fi, j) {
+		if got, size, err := hashFile(finalname); err == nil && got == sha {
+			report.cached = sizeBytes(size)
+		}
+	}
+
+	if report.cached == 0 && gf.CacheDir != "" {
+		size, err := gf.copyFromCache(j, sha, finalname)
+		if err != nil {
+			if gf.Verbose {
+				gf.log("Cannot use cached %s for %s, fetching it: %v", sha, j.filename, err)
+			}
+			return nil
+		}
+		report.cached = size
+	}
+	if report.cached == 0 {
+		return nil
+	}
+
+	report.completed = time.Now()
+	report.success = true
+	report.finalname = finalname
+	report.attempts = []jobAttempt{{started: started, duration: report.completed.Sub(started)}}
+	if gf.Verbose {
+		gf.log("Using local copy of %s for %s", sha, j.filename)
+	}
+	return report
+}
+
+// copyFromCache materializes the cached blob sha at finalname, as a hardlink
+// if the cached file already has the attributes of job j, and as a copy
+// otherwise. It returns the size of the blob.
+func (gf *Fetcher) copyFromCache(j job, sha, finalname string) (sizeBytes, error) {
+	cached := gf.cachePath(sha)
+	fi, err := os.Lstat(cached)
+	if err != nil {
+		return 0, err
+	}
+	got, size, err := hashFile(cached)
+	if err != nil {
+		return 0, err
+	}
+	if got != sha {
+		// The cache entry was modified, e.g. through a hardlink in the
+		// destination of an earlier build; drop it.
+		os.Remove(cached)
+		return 0, fmt.Errorf("cached file %s has SHA %s", cached, got)
+	}
+
+	if err := gf.install(j, cached, finalname, hasAttrs(fi, j)); err != nil {
+		return 0, err
+	}
+	return sizeBytes(size), nil
+}
+
+// install puts a copy of the local file src at finalname, with the
+// attributes of job j. If link is set, src already has these attributes and
+// is hardlinked rather than copied, if possible.
+func (gf *Fetcher) install(j job, src, finalname string, link bool) error {
+	tmpfile := filepath.Join(gf.StagingDir, fmt.Sprintf("local-%d", gf.tempSeq()))
+	if err := gf.ensureFolders(tmpfile); err != nil {
+		return err
+	}
+	if !link || os.Link(src, tmpfile) != nil {
+		if err := gf.copyFrom(src, tmpfile); err != nil {
+			return err
+		}
+		mode := j.fileMode()
+		if err := gf.OS.Chmod(tmpfile, mode); err != nil {
+			return fmt.Errorf("chmod %q to %v: %v", tmpfile, mode, err)
+		}
+		if !j.mtime.IsZero() {
+			if err := gf.OS.Chtimes(tmpfile, j.mtime, j.mtime); err != nil {
+				return fmt.Errorf("setting modification time of %q to %v: %v", tmpfile, j.mtime, err)
+			}
+		}
+	}
+
+	if err := gf.ensureFolders(finalname); err != nil {
+		return err
+	}
+	if err := gf.OS.Rename(tmpfile, finalname); err != nil {
+		return fmt.Errorf("renaming %q to %q: %v", tmpfile, finalname, err)
+	}
+	return nil
+}
+
+// copyFrom copies the file src to the new file dest.
+func (gf *Fetcher) copyFrom(src, dest string) (err error) {
+	r, err := gf.OS.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := gf.OS.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := w.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("closing %q: %v", dest, cerr)
+		}
+	}()
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("copying %q to %q: %v", src, dest, err)
+	}
+	return nil
+}
+
+// addToCache adds the file fetched for job j at finalname to the local cache,
+// preferably as a hardlink. This is best effort only: failures are logged
+// and otherwise ignored.
+func (gf *Fetcher) addToCache(j job, finalname string) {
+	sha := normalizeHex(j.sha1sum)
+	if gf.CacheDir == "" || len(sha) != 2*sha1.Size {
+		return
+	}
+	cached := gf.cachePath(sha)
+	if _, err := os.Lstat(cached); err == nil {
+		return
+	}
+
+	// Add the file under a temp name first, so that the cache never holds a
+	// partially written entry.
+	err := os.MkdirAll(filepath.Dir(cached), 0777)
+	tmpfile := fmt.Sprintf("%s.%d-%d.tmp", cached, os.Getpid(), gf.tempSeq())
+	if err == nil && os.Link(finalname, tmpfile) != nil {
+		err = gf.copyFrom(finalname, tmpfile)
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, cached)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		gf.log("Failed to add %s to cache %s, continuing: %v", j.filename, gf.CacheDir, err)
+	}
+}
+
+// deduper tells the jobs for distinct files from the jobs for duplicates of
+// these, i.e. entries with the same SHA1 or SHA256 checksum, or with the same
+// source if they have neither, in the order in which they are added.
+type deduper map[string]string
+
+// add returns whether job j duplicates a job added before. If so, j is set
+// up to be copied from the path of the job it duplicates.
+func (d deduper) add(j job) (job, bool) {
+	key := normalizeHex(j.sha1sum)
+	if key == "" && j.sha256sum != "" {
+		key = "sha256:" + normalizeHex(j.sha256sum)
+	}
+	if key == "" {
+		key = formatGCSName(j.bucket, j.object, j.generation)
+	}
+	if primary, ok := d[key]; ok {
+		j.copyOf = primary
+		return j, true
+	}
+	d[key] = j.filename
+	return j, false
+}
+
+// copyDuplicate copies the file fetched for the entry that job j duplicates.
+// It returns nil if that fails, in which case j must be fetched from GCS.
+func (gf *Fetcher) copyDuplicate(j job) *jobReport {
+	started := time.Now()
+	src := filepath.Join(gf.DestDir, j.copyOf)
+	finalname := filepath.Join(gf.DestDir, j.filename)
+	fi, err := os.Stat(src)
+	if err == nil {
+		err = gf.install(j, src, finalname, false)
+	}
+	if err != nil {
+		gf.log("Failed to copy %s to %s, fetching it: %v", j.copyOf, j.filename, err)
+		return nil
+	}
+
+	report := &jobReport{job: j, started: started, completed: time.Now()}
+	report.success = true
+	report.finalname = finalname
+	report.copied = sizeBytes(fi.Size())
+	report.attempts = []jobAttempt{{started: started, duration: report.completed.Sub(started)}}
+	return report
+}
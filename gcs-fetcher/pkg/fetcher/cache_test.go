@@ -0,0 +1,157 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// countingGCS counts the readers created for objects other than manifests.
+type countingGCS struct {
+	GCS
+
+	mu    sync.Mutex
+	reads int
+}
+
+func (c *countingGCS) NewReader(ctx context.Context, bucket, object string, generation int64) (io.ReadCloser, error) {
+	if filepath.Ext(object) != ".json" {
+		c.mu.Lock()
+		c.reads++
+		c.mu.Unlock()
+	}
+	return c.GCS.NewReader(ctx, bucket, object, generation)
+}
+
+const cacheManifest = "cache-manifest.json"
+
+// cacheManifestContents references sfile1 twice, with different modes, and
+// sfile2 once, all with their SHA1 checksums.
+var cacheManifestContents = []byte(fmt.Sprintf(`{
+	"a.js":      {"sourceUrl": "gs://success-bucket/sfile1.js", "sha1sum": "%x", "mode": 420, "mtime": "2019-03-04T05:06:07Z"},
+	"bin/a.js":  {"sourceUrl": "gs://success-bucket/sfile1.js", "sha1sum": "%x", "mode": 493},
+	"dir/b.txt": {"sourceUrl": "gs://success-bucket/sfile2.jpg", "sha1sum": "%X"}
+}`, sha1.Sum(sfile1Contents), sha1.Sum(sfile1Contents), sha1.Sum(sfile2Contents)))
+
+func TestFetchFromManifestCache(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	cacheDir := filepath.Join(tc.workDir, ".cache")
+	tc.gcs.objects[formatGCSName(successBucket, cacheManifest, generation)] = fakeGCSResponse{content: cacheManifestContents}
+	gcs := &countingGCS{GCS: tc.gcs}
+	tc.gf.GCS = gcs
+	tc.gf.Object = cacheManifest
+
+	// fetch fetches the manifest into dest, and returns the number of files
+	// read from GCS.
+	fetch := func(dest string) int {
+		t.Helper()
+		gcs.reads = 0
+		tc.gf.DestDir = dest
+		tc.gf.StagingDir = filepath.Join(dest, ".staging")
+		tc.gf.CreatedDirs = map[string]bool{}
+		if err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+			t.Fatalf("fetchFromManifest() got %v, want nil", err)
+		}
+		for _, c := range []struct {
+			name     string
+			contents []byte
+			mode     os.FileMode
+		}{
+			{"a.js", sfile1Contents, 0644},
+			{"bin/a.js", sfile1Contents, 0755},
+			{"dir/b.txt", sfile2Contents, defaultFileMode},
+		} {
+			name := filepath.Join(dest, c.name)
+			b, err := ioutil.ReadFile(name)
+			if err != nil || string(b) != string(c.contents) {
+				t.Errorf("ReadFile(%s) got (%q, %v), want (%q, nil)", name, b, err, c.contents)
+			}
+			if fi, err := os.Stat(name); err != nil || fi.Mode() != c.mode {
+				t.Errorf("Stat(%s) got mode %v (err %v), want %v", name, fi.Mode(), err, c.mode)
+			}
+		}
+		return gcs.reads
+	}
+
+	// Without a cache, every distinct file is fetched, but a second fetch into
+	// the same destination finds all files in place.
+	first := filepath.Join(tc.workDir, "first")
+	if got := fetch(first); got != 2 {
+		t.Errorf("fetch into empty destination got %d reads, want 2", got)
+	}
+	if got := fetch(first); got != 0 {
+		t.Errorf("fetch into populated destination got %d reads, want 0", got)
+	}
+
+	// With a cache, fetched files are added to it, and used for a fetch into
+	// a different destination.
+	tc.gf.CacheDir = cacheDir
+	if got := fetch(filepath.Join(tc.workDir, "second")); got != 2 {
+		t.Errorf("fetch with empty cache got %d reads, want 2", got)
+	}
+	if got := fetch(filepath.Join(tc.workDir, "third")); got != 0 {
+		t.Errorf("fetch with populated cache got %d reads, want 0", got)
+	}
+
+	// Corrupted cache entries are detected and fetched again.
+	sha := fmt.Sprintf("%x", sha1.Sum(sfile2Contents))
+	cached := tc.gf.cachePath(sha)
+	os.Chmod(cached, 0644)
+	if err := ioutil.WriteFile(cached, []byte("corrupted"), 0644); err != nil {
+		t.Fatalf("WriteFile(%s): %v", cached, err)
+	}
+	if got := fetch(filepath.Join(tc.workDir, "fourth")); got != 1 {
+		t.Errorf("fetch with corrupted cache got %d reads, want 1", got)
+	}
+	if got, _, err := hashFile(cached); err != nil || got != sha {
+		t.Errorf("hashFile(%s) got (%s, %v), want (%s, nil)", cached, got, err, sha)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	jobs := []job{
+		{filename: "d", bucket: "b", object: "o2"},
+		{filename: "a", bucket: "b", object: "o1", sha1sum: "AB12"},
+		{filename: "c", bucket: "b", object: "o3", sha1sum: "ab12"},
+		{filename: "b", bucket: "b", object: "o2"},
+		{filename: "e", bucket: "b", object: "o2", generation: generation},
+	}
+	d := deduper{}
+	var got []string
+	for _, j := range jobs {
+		if j, dup := d.add(j); dup {
+			got = append(got, j.filename+"<"+j.copyOf)
+		} else {
+			got = append(got, j.filename)
+		}
+	}
+	// The first of the duplicates is picked for download.
+	want := []string{"d", "a", "c<a", "b<d", "e"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("deduper.add() got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+// checksums computes the checksums that the download of a job is verified
+// against: the SHA1 and SHA256 checksums recorded in the manifest, and the
+// CRC32C and MD5 checksums of the object's attributes, as far as they are
+// known. Only the checksums that can be verified are computed.
+type checksums struct {
+	j                    job
+	sha1, sha256, md5    hash.Hash
+	crc32c               hash.Hash32
+	sha1Want, sha256Want string
+}
+
+func newChecksums(j job) *checksums {
+	c := &checksums{j: j}
+	if c.sha1Want = normalizeHex(j.sha1sum); c.sha1Want != "" {
+		c.sha1 = sha1.New()
+	}
+	if c.sha256Want = normalizeHex(j.sha256sum); c.sha256Want != "" {
+		c.sha256 = sha256.New()
+	}
+	if j.attrs != nil {
+		if !j.attrs.NoCRC32C {
+			c.crc32c = crc32.New(crc32cTable)
+		}
+		if len(j.attrs.MD5) > 0 {
+			c.md5 = md5.New()
+		}
+	}
+	return c
+}
+
+// verifiable reports whether there is any checksum to verify the download of
+// job j against.
+func verifiable(j job) bool {
+	return j.sha1sum != "" || j.sha256sum != "" || (j.attrs != nil && (!j.attrs.NoCRC32C || len(j.attrs.MD5) > 0))
+}
+
+func (c *checksums) Write(p []byte) (int, error) {
+	for _, h := range []hash.Hash{c.sha1, c.sha256, c.md5} {
+		if h != nil {
+			h.Write(p)
+		}
+	}
+	if c.crc32c != nil {
+		c.crc32c.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify returns a ChecksumError for the first checksum that does not match
+// the bytes written to c, if any.
+func (c *checksums) verify() error {
+	mismatch := func(algorithm, got, want string) error {
+		return &ChecksumError{JobInfo: c.j.info(), Algorithm: algorithm, Got: got, Want: want}
+	}
+	if c.crc32c != nil {
+		if got, want := c.crc32c.Sum32(), c.j.attrs.CRC32C; got != want {
+			return mismatch("CRC32C", fmt.Sprintf("%08x", got), fmt.Sprintf("%08x", want))
+		}
+	}
+	if c.md5 != nil {
+		if got, want := fmt.Sprintf("%x", c.md5.Sum(nil)), fmt.Sprintf("%x", c.j.attrs.MD5); got != want {
+			return mismatch("MD5", got, want)
+		}
+	}
+	if c.sha1 != nil {
+		if got := fmt.Sprintf("%x", c.sha1.Sum(nil)); got != c.sha1Want {
+			return mismatch("SHA1", got, c.sha1Want)
+		}
+	}
+	if c.sha256 != nil {
+		if got := fmt.Sprintf("%x", c.sha256.Sum(nil)); got != c.sha256Want {
+			return mismatch("SHA256", got, c.sha256Want)
+		}
+	}
+	return nil
+}
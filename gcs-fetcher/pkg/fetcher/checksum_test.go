@@ -0,0 +1,230 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+// attrsGCS adds object attributes to fakeGCS, with the checksums of the
+// objects, except for the objects in noAttrs, whose attributes are denied.
+// badCRC32C and badMD5 corrupt the respective checksums. calls counts the
+// requests for attributes, the first unavailable of which fail with 503.
+type attrsGCS struct {
+	*fakeGCS
+	noAttrs           map[string]bool
+	badCRC32C, badMD5 bool
+	calls             int32
+	unavailable       int32
+}
+
+func (f *attrsGCS) Attrs(ctx context.Context, bucket, object string, gen int64) (*ObjectAttrs, error) {
+	if atomic.AddInt32(&f.calls, 1) <= f.unavailable {
+		return nil, &googleapi.Error{Code: http.StatusServiceUnavailable}
+	}
+	if f.noAttrs[object] {
+		return nil, &googleapi.Error{Code: http.StatusForbidden, Message: "metadata denied"}
+	}
+	content := f.objects[formatGCSName(bucket, object, generation)].content
+	attrs := &ObjectAttrs{Size: int64(len(content)), Generation: generation, CRC32C: crc32.Checksum(content, crc32cTable)}
+	sum := md5.Sum(content)
+	attrs.MD5 = sum[:]
+	if f.badCRC32C {
+		attrs.CRC32C++
+	}
+	if f.badMD5 {
+		attrs.MD5 = []byte("bad")
+	}
+	return attrs, nil
+}
+
+func TestFetchObjectVerifiesObjectChecksums(t *testing.T) {
+	for _, c := range []struct {
+		name              string
+		badCRC32C, badMD5 bool
+		wantAlgorithm     string
+	}{
+		{"valid", false, false, ""},
+		{"bad CRC32C", true, false, "CRC32C"},
+		{"bad MD5", false, true, "MD5"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tc, teardown := buildTestContext(t)
+			defer teardown()
+			tc.gf.GCS = &attrsGCS{fakeGCS: tc.gcs, badCRC32C: c.badCRC32C, badMD5: c.badMD5}
+
+			report := tc.gf.fetchObject(context.Background(), job{filename: sfile1, bucket: successBucket, object: sfile1})
+			if c.wantAlgorithm == "" {
+				if !report.success {
+					t.Errorf("fetchObject() got err %v, want success", report.err)
+				}
+				return
+			}
+			var cerr *ChecksumError
+			if !errors.As(report.err, &cerr) || cerr.Algorithm != c.wantAlgorithm {
+				t.Fatalf("fetchObject() got err %v, want %s mismatch", report.err, c.wantAlgorithm)
+			}
+			// The read was pinned to the generation of the attributes, whose
+			// checksums never change.
+			if cerr.Generation != generation || len(report.attempts) != 1 {
+				t.Errorf("fetchObject() got mismatch for generation %d after %d attempts, want generation %d after 1", cerr.Generation, len(report.attempts), generation)
+			}
+		})
+	}
+}
+
+func TestFetchObjectGetsAttrsOnlyWithoutChecksums(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+	gcs := &attrsGCS{fakeGCS: tc.gcs}
+	tc.gf.GCS = gcs
+
+	j := job{filename: sfile1, bucket: successBucket, object: sfile1, sha1sum: fmt.Sprintf("%x", sha1.Sum(sfile1Contents)), size: int64(len(sfile1Contents))}
+	if report := tc.gf.fetchObject(context.Background(), j); !report.success || gcs.calls != 0 {
+		t.Errorf("fetchObject() with a SHA-1 and size got %d attribute requests (%v), want 0", gcs.calls, report.err)
+	}
+	j.sha1sum = ""
+	if report := tc.gf.fetchObject(context.Background(), j); !report.success || gcs.calls != 1 {
+		t.Errorf("fetchObject() without a checksum got %d attribute requests (%v), want 1", gcs.calls, report.err)
+	}
+
+	// Attribute requests are retried like downloads.
+	gcs.calls, gcs.unavailable = 0, 1
+	report := tc.gf.fetchObject(context.Background(), j)
+	if !report.success || gcs.calls != 2 || len(report.attempts) != 2 || report.attempts[0].class != throttledError {
+		t.Errorf("fetchObject() with unavailable attributes got %d attribute requests in %d attempts (%v), want 2 after a throttled attempt", gcs.calls, len(report.attempts), report.err)
+	}
+	if report.job.attrs == nil {
+		t.Errorf("fetchObject() got no attributes, want them from the retry")
+	}
+}
+
+func TestFetchFromManifestAttrsDenied(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	var log bytes.Buffer
+	tc.gf.Stdout = &log
+	tc.gf.GCS = &attrsGCS{fakeGCS: tc.gcs, noAttrs: map[string]bool{sfile1: true, sfile2: true, sfile3: true}}
+	tc.gf.SourceType = "Manifest"
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() got %v, want nil", err)
+	}
+	if got := strings.Count(log.String(), "Failed to get attributes"); got != 1 {
+		t.Errorf("Fetch() logged %d attribute failures, want 1:\n%s", got, log.String())
+	}
+}
+
+func TestFetchFromManifestVerifiesSha256(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		sha256      string
+		wantSuccess bool
+	}{
+		{"valid", fmt.Sprintf("%X", sha256.Sum256(sfile1Contents)), true},
+		{"mismatch", fmt.Sprintf("%x", sha256.Sum256(sfile2Contents)), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tc, teardown := buildTestContext(t)
+			defer teardown()
+
+			manifest := "sha256-manifest.json"
+			tc.gcs.objects[formatGCSName(successBucket, manifest, generation)] = fakeGCSResponse{content: []byte(fmt.Sprintf(`{
+				"a.js": {"sourceUrl": "gs://success-bucket/sfile1.js#12345", "sha256": %q}
+			}`, c.sha256))}
+			tc.gf.Object = manifest
+
+			err := tc.gf.fetchFromManifest(context.Background())
+			if c.wantSuccess {
+				if err != nil {
+					t.Errorf("fetchFromManifest() got %v, want nil", err)
+				}
+				return
+			}
+			var cerr *ChecksumError
+			if !errors.As(err, &cerr) || cerr.Algorithm != "SHA256" {
+				t.Errorf("fetchFromManifest() got %v, want SHA256 mismatch", err)
+			}
+		})
+	}
+}
+
+func TestFetchFromManifestRequireChecksums(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	manifest := "require-manifest.json"
+	tc.gcs.objects[formatGCSName(successBucket, manifest, generation)] = fakeGCSResponse{content: []byte(fmt.Sprintf(`{
+		"a.js":  {"sourceUrl": "gs://success-bucket/sfile1.js", "sha256": "%x"},
+		"b.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"},
+		"c":     {"sourceUrl": "gs://success-bucket/sfile3"}
+	}`, sha256.Sum256(sfile1Contents)))}
+	tc.gf.Object = manifest
+	tc.gf.RequireChecksums = true
+	// sfile1 has a checksum in the manifest, sfile2 in its attributes, sfile3
+	// has none.
+	tc.gf.GCS = &attrsGCS{fakeGCS: tc.gcs, noAttrs: map[string]bool{sfile1: true, sfile3: true}}
+
+	err := tc.gf.fetchFromManifest(context.Background())
+	var ferr *FetchError
+	if !errors.As(err, &ferr) || len(ferr.Errs) != 1 {
+		t.Fatalf("fetchFromManifest() got %v, want 1 error", err)
+	}
+	var uerr *UnverifiableError
+	if !errors.As(err, &uerr) || uerr.Object != sfile3 {
+		t.Errorf("fetchFromManifest() got %v, want UnverifiableError for %s", err, sfile3)
+	}
+	for _, name := range []string{"a.js", "b.jpg"} {
+		if _, err := tc.os.Open(filepath.Join(tc.gf.DestDir, name)); err != nil {
+			t.Errorf("Open(%s) got %v, want nil", name, err)
+		}
+	}
+}
+
+func TestStreamArchiveVerifiesChecksums(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	object := "source.tar.gz"
+	tc.gcs.objects[formatGCSName(successBucket, object, generation)] = fakeGCSResponse{content: buildArchive(t, "TarGzArchive")}
+	tc.gf.GCS = &attrsGCS{fakeGCS: tc.gcs, badCRC32C: true}
+	tc.gf.Object = object
+	tc.gf.SourceType = "Auto"
+	tc.gf.Stream = true
+
+	err := tc.gf.Fetch(context.Background())
+	var cerr *ChecksumError
+	if !errors.As(err, &cerr) || cerr.Algorithm != "CRC32C" {
+		t.Fatalf("Fetch() got %v, want CRC32C mismatch", err)
+	}
+	if got := listFiles(t, tc.gf.DestDir); len(got) != 0 {
+		t.Errorf("files after Fetch() got %v, want none", got)
+	}
+}
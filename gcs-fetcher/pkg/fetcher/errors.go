@@ -0,0 +1,203 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JobInfo identifies the file that a fetch failed for.
+type JobInfo struct {
+	Filename       string // Path of the file, relative to its destination directory.
+	Bucket, Object string
+	Generation     int64 // Zero if the object was not pinned to a generation.
+}
+
+func (j job) info() JobInfo {
+	return JobInfo{
+		Filename:   j.filename,
+		Bucket:     j.bucket,
+		Object:     j.object,
+		Generation: j.generation,
+	}
+}
+
+// PermissionError is returned when GCS, or another storage backend, denies
+// access to an object.
+type PermissionError struct {
+	JobInfo
+	Robot string // The account that needs to be granted access; only set for GCS.
+}
+
+func (e *PermissionError) Error() string {
+	if e.Robot == "" {
+		return fmt.Sprintf("Access to %s denied.", formatGCSName(e.Bucket, e.Object, e.Generation))
+	}
+	return fmt.Sprintf("Access to bucket %s denied. You must grant Storage Object Viewer permission to %s. If you are using VPC Service Controls, you must also grant it access to your service perimeter.", e.Bucket, e.Robot)
+}
+
+// UserProjectError is returned when an object is in a requester-pays bucket,
+// and no project to bill was given.
+type UserProjectError struct {
+	JobInfo
+}
+
+func (e *UserProjectError) Error() string {
+	return fmt.Sprintf("bucket %s is a requester-pays bucket; set --billing_project to the project to bill for reading %s", e.Bucket, formatGCSName(e.Bucket, e.Object, e.Generation))
+}
+
+// EncryptionKeyError is returned when an object is encrypted with a
+// customer-supplied encryption key that was not given, or not the one given.
+type EncryptionKeyError struct {
+	JobInfo
+	Incorrect bool // Whether a key was given, but not the object's.
+}
+
+func (e *EncryptionKeyError) Error() string {
+	if e.Incorrect {
+		return fmt.Sprintf("%s is encrypted with a different customer-supplied encryption key than the one of --encryption_key_file", formatGCSName(e.Bucket, e.Object, e.Generation))
+	}
+	return fmt.Sprintf("%s is encrypted with a customer-supplied encryption key; set --encryption_key_file to the file holding it", formatGCSName(e.Bucket, e.Object, e.Generation))
+}
+
+// NotFoundError is returned when an object, or the generation of it that a
+// manifest pinned, does not exist.
+type NotFoundError struct {
+	JobInfo
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Generation > 0 {
+		return fmt.Sprintf("generation %d of %s no longer exists; the object may have been overwritten or deleted since it was pinned", e.Generation, formatGCSName(e.Bucket, e.Object, 0))
+	}
+	return fmt.Sprintf("object %s does not exist", formatGCSName(e.Bucket, e.Object, 0))
+}
+
+// ChecksumError is returned when the contents of a fetched file do not match
+// their expected checksum.
+type ChecksumError struct {
+	JobInfo
+	Algorithm string // The checksum algorithm, e.g. "SHA1".
+	Got, Want string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s %s mismatch, got %q, want %q", e.Filename, e.Algorithm, e.Got, e.Want)
+}
+
+// UnverifiableError is returned with Fetcher.RequireChecksums for a file that
+// has no checksum to verify it against.
+type UnverifiableError struct {
+	JobInfo
+}
+
+func (e *UnverifiableError) Error() string {
+	return fmt.Sprintf("%s has no checksum to verify it against", formatGCSName(e.Bucket, e.Object, e.Generation))
+}
+
+// TimeoutError is returned when all attempts to fetch a file timed out.
+type TimeoutError struct {
+	JobInfo
+	Attempts int
+	Timeout  time.Duration // The timeout of the last attempt.
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("fetching %s timed out %d times, the last time after %v", formatGCSName(e.Bucket, e.Object, e.Generation), e.Attempts, e.Timeout)
+}
+
+// FetchError is returned when at least one file of a fetch failed. Errs
+// holds the error of every failed file, which may be any of the error types
+// above; errors.As finds them.
+type FetchError struct {
+	Errs []error
+}
+
+func (e *FetchError) Error() string {
+	es := []string{fmt.Sprintf("Errors (%d):", len(e.Errs))}
+	for _, err := range e.Errs {
+		es = append(es, fmt.Sprintf(" - %s", err))
+	}
+	return strings.Join(es, "\n")
+}
+
+func (e *FetchError) Unwrap() []error {
+	return e.Errs
+}
+
+// InterruptedError is returned when a fetch was cancelled, or ran out of
+// its deadline, before it completed. Err is the error that the fetch failed
+// with as a result, which may hold the errors of files as well.
+type InterruptedError struct {
+	Cause error // context.Canceled or context.DeadlineExceeded.
+	Err   error
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("fetch interrupted: %v", e.Cause)
+}
+
+func (e *InterruptedError) Unwrap() []error {
+	return []error{e.Cause, e.Err}
+}
+
+// timeoutExhausted replaces the error of a failed report by a TimeoutError if
+// its last attempt timed out.
+func timeoutExhausted(report *jobReport) {
+	if report.success || len(report.attempts) == 0 {
+		return
+	}
+	last := report.attempts[len(report.attempts)-1]
+	if errors.Is(last.err, errGCSTimeout) {
+		report.err = &TimeoutError{JobInfo: report.job.info(), Attempts: len(report.attempts), Timeout: last.gcsTimeout}
+	}
+}
+
+// DriftError is returned by a verification when the destination does not
+// match the manifest. Each field holds the paths, relative to the
+// destination, of one kind of drift.
+type DriftError struct {
+	Missing   []string `json:"missing,omitempty"`   // Listed in the manifest, but absent.
+	Extra     []string `json:"extra,omitempty"`     // Present, but not listed in the manifest.
+	Modified  []string `json:"modified,omitempty"`  // Contents or file type differ from the manifest.
+	WrongMode []string `json:"wrongMode,omitempty"` // Contents match, but the mode differs.
+}
+
+func (e *DriftError) Error() string {
+	es := []string{fmt.Sprintf("Destination does not match the manifest (%d missing, %d extra, %d modified, %d wrong mode):",
+		len(e.Missing), len(e.Extra), len(e.Modified), len(e.WrongMode))}
+	for _, d := range []struct {
+		kind  string
+		paths []string
+	}{
+		{"missing", e.Missing},
+		{"extra", e.Extra},
+		{"modified", e.Modified},
+		{"wrong mode", e.WrongMode},
+	} {
+		for _, p := range d.paths {
+			es = append(es, fmt.Sprintf(" - %s: %s", d.kind, p))
+		}
+	}
+	return strings.Join(es, "\n")
+}
+
+func (e *DriftError) empty() bool {
+	return len(e.Missing) == 0 && len(e.Extra) == 0 && len(e.Modified) == 0 && len(e.WrongMode) == 0
+}
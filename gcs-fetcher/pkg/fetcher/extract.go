@@ -0,0 +1,848 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// ratioCheckMinBytes is the number of bytes that must have been extracted
+// before the compression ratio limit is enforced, so that the ratio is not
+// judged on the first few (highly compressible) headers of an archive.
+const ratioCheckMinBytes = 1 << 20
+
+// Archives are untrusted, so only the permission bits of their entries are
+// applied to the extracted files, and the sticky bit to directories; setuid
+// and setgid bits are never restored, unlike those recorded in manifests.
+const (
+	extractedFileModeBits = os.ModePerm
+	extractedDirModeBits  = os.ModePerm | os.ModeSticky
+)
+
+// Policies for archive entries that cannot be extracted, such as device
+// nodes and fifos.
+const (
+	// UnsupportedEntriesError fails the fetch.
+	UnsupportedEntriesError = "error"
+	// UnsupportedEntriesWarn logs a warning and skips the entry.
+	UnsupportedEntriesWarn = "warn"
+	// UnsupportedEntriesSkip silently skips the entry.
+	UnsupportedEntriesSkip = "skip"
+)
+
+// decompressor returns a reader of the tar stream held in the compressed
+// archive r.
+type decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// tarDecompressors maps each tar based source type to the decompressor for
+// its archives.
+var tarDecompressors = map[string]decompressor{
+	"TarArchive": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(r), nil
+	},
+	"TarGzArchive": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"TarZstdArchive": func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+	"TarXzArchive": func(r io.Reader) (io.ReadCloser, error) {
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	},
+	"TarBz2Archive": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	},
+}
+
+// archiveMagic identifies archive source types by the leading bytes of the
+// archive. Plain tar archives are recognized by their header instead, see
+// sniffArchiveType.
+var archiveMagic = []struct {
+	magic      []byte
+	sourceType string
+}{
+	{[]byte("PK\x03\x04"), "ZipArchive"},
+	{[]byte("PK\x05\x06"), "ZipArchive"}, // Empty zip archive.
+	{[]byte{0x1f, 0x8b}, "TarGzArchive"},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, "TarZstdArchive"},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, "TarXzArchive"},
+	{[]byte("BZh"), "TarBz2Archive"},
+}
+
+// sniffLen is the number of leading bytes needed to identify an archive.
+const sniffLen = 512
+
+// sniffArchiveType returns the source type of the archive starting with
+// header, or "" if it is not recognized.
+func sniffArchiveType(header []byte) string {
+	for _, m := range archiveMagic {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.sourceType
+		}
+	}
+	// The ustar magic lives at offset 257 of the first tar header.
+	if len(header) >= 262 && string(header[257:262]) == "ustar" {
+		return "TarArchive"
+	}
+	return ""
+}
+
+// detectArchiveType returns the source type of the archive file name.
+func detectArchiveType(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("opening archive %s: %v", name, err)
+	}
+	defer f.Close()
+	header := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("reading archive %s: %v", name, err)
+	}
+	sourceType := sniffArchiveType(header[:n])
+	if sourceType == "" {
+		return "", fmt.Errorf("cannot detect the archive type of %s; specify it with -type", name)
+	}
+	return sourceType, nil
+}
+
+// extractor writes archive entries below dest. Directory permissions and
+// timestamps are only applied by finish, once all entries have been written,
+// so that read-only directories can still be populated and directory mtimes
+// are not disturbed by the entries written into them.
+//
+// Archive entries are untrusted: every write is confined to dest, and the
+// extraction fails as soon as it exceeds any of the configured limits.
+type extractor struct {
+	dest        string
+	unsupported string
+	logf        func(format string, a ...interface{})
+
+	// maxBytes, maxEntries and maxRatio limit the total number of bytes
+	// written, the number of entries and the ratio of bytes written to
+	// compressed bytes read; zero means unlimited. compressed reports the
+	// number of compressed bytes consumed so far.
+	maxBytes   int64
+	maxEntries int
+	maxRatio   float64
+	compressed func() int64
+
+	// filter selects the entries to extract; filtered counts the others.
+	filter   *pathFilter
+	filtered int
+
+	// workers is the number of zip entries extracted concurrently, see
+	// unzipParallel.
+	workers int
+
+	// mu guards numFiles and written, which files extracted concurrently
+	// update.
+	mu       sync.Mutex
+	numFiles int
+	entries  int
+	written  int64
+	dirs     []dirAttrs
+
+	// safeDirs are directories below dest that are known not to be symlinks.
+	safeDirs map[string]bool
+
+	// created are the paths created by the extraction, see undo.
+	created []string
+}
+
+// dirAttrs are the attributes of a directory entry that are applied once
+// extraction completes.
+type dirAttrs struct {
+	path  string
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func newExtractor(dest string) *extractor {
+	return &extractor{
+		dest:        dest,
+		unsupported: UnsupportedEntriesWarn,
+		logf:        log.Printf,
+		compressed:  func() int64 { return 0 },
+		workers:     1,
+		safeDirs:    map[string]bool{},
+	}
+}
+
+// newExtractor returns an extractor into gf.DestDir configured from gf.
+// compressedSize is the size of the archive being extracted.
+func (gf *Fetcher) newExtractor(compressedSize int64) *extractor {
+	x := newExtractor(gf.DestDir)
+	if gf.UnsupportedEntries != "" {
+		x.unsupported = gf.UnsupportedEntries
+	}
+	x.logf = gf.log
+	x.maxBytes = gf.MaxExtractBytes
+	x.maxEntries = gf.MaxExtractEntries
+	x.maxRatio = gf.MaxCompressionRatio
+	x.filter = gf.filter
+	if gf.WorkerCount > 1 {
+		x.workers = gf.WorkerCount
+	}
+	x.compressed = func() int64 { return compressedSize }
+	return x
+}
+
+// target returns the path that the archive entry name is extracted to. It
+// fails if name is absolute, escapes dest, or leads through a symlink, so
+// that an entry can never be written outside of dest.
+func (x *extractor) target(name string) (string, error) {
+	rel, err := confine(name)
+	if err != nil {
+		return "", fmt.Errorf("archive entry %q: %v", name, err)
+	}
+	if err := x.checkNoSymlinks(filepath.Dir(rel)); err != nil {
+		return "", fmt.Errorf("archive entry %q: %v", name, err)
+	}
+	return filepath.Join(x.dest, rel), nil
+}
+
+// confine returns name as a clean path relative to the extraction root, or
+// an error if name is absolute or refers to a location outside of it.
+func confine(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("empty path")
+	}
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("absolute path is not allowed")
+	}
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes the destination directory")
+	}
+	return rel, nil
+}
+
+// checkNoSymlinks verifies that none of the directories on the path rel below
+// dest is a symlink, which an earlier entry could have planted to redirect
+// writes outside of dest.
+func (x *extractor) checkNoSymlinks(rel string) error {
+	if rel == "." || x.safeDirs[rel] {
+		return nil
+	}
+	if err := x.checkNoSymlinks(filepath.Dir(rel)); err != nil {
+		return err
+	}
+	info, err := os.Lstat(filepath.Join(x.dest, rel))
+	switch {
+	case os.IsNotExist(err):
+		// Will be created as a real directory.
+		return nil
+	case err != nil:
+		return fmt.Errorf("checking %s: %v", rel, err)
+	case info.Mode()&os.ModeSymlink != 0:
+		return fmt.Errorf("path leads through symlink %s", rel)
+	}
+	x.safeDirs[rel] = true
+	return nil
+}
+
+// selected reports whether the archive entry name should be extracted, and
+// counts it as filtered if not.
+func (x *extractor) selected(name string) bool {
+	if x.filter.match(name) {
+		return true
+	}
+	x.filtered++
+	return false
+}
+
+// addEntry counts an archive entry against the entry limit.
+func (x *extractor) addEntry() error {
+	x.entries++
+	if x.maxEntries > 0 && x.entries > x.maxEntries {
+		return fmt.Errorf("archive has more than %d entries, refusing to extract", x.maxEntries)
+	}
+	return nil
+}
+
+// Write counts bytes being extracted against the size and compression ratio
+// limits; it does not write anything.
+func (x *extractor) Write(p []byte) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.written += int64(len(p))
+	if x.maxBytes > 0 && x.written > x.maxBytes {
+		return 0, fmt.Errorf("archive expands to more than %d bytes, refusing to extract", x.maxBytes)
+	}
+	if x.maxRatio > 0 && x.written > ratioCheckMinBytes {
+		if compressed := x.compressed(); compressed > 0 && float64(x.written) > x.maxRatio*float64(compressed) {
+			return 0, fmt.Errorf("archive expands to more than %.0f times its compressed size of %d bytes, refusing to extract", x.maxRatio, compressed)
+		}
+	}
+	return len(p), nil
+}
+
+// prepare makes sure that the parent directories of target exist and that
+// nothing but a directory is left at target itself, so that a new entry can
+// be created there.
+func (x *extractor) prepare(target string) error {
+	x.track(target)
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return fmt.Errorf("making parent directories for %s: %v", target, err)
+	}
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return fmt.Errorf("removing existing file %s: %v", target, err)
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("checking existence on %s: %v", target, err)
+	}
+	return nil
+}
+
+// track records that target is about to be created, along with any of its
+// missing parent directories.
+func (x *extractor) track(target string) {
+	if missing := firstMissing(target); missing != "" {
+		x.created = append(x.created, missing)
+	} else {
+		// target exists already and will be replaced.
+		x.created = append(x.created, target)
+	}
+}
+
+// firstMissing returns the topmost of path and its ancestors that does not
+// exist, or "" if path exists.
+func firstMissing(path string) string {
+	missing := ""
+	for p := path; ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil {
+			return missing
+		}
+		missing = p
+		if filepath.Dir(p) == p {
+			return missing
+		}
+	}
+}
+
+// undo removes everything created by the extraction so far, so that a failed
+// extraction can be restarted from a clean state. Entries that replaced
+// existing files are removed as well.
+func (x *extractor) undo() error {
+	var first error
+	for i := len(x.created) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(x.created[i]); err != nil && first == nil {
+			first = fmt.Errorf("removing partially extracted %s: %v", x.created[i], err)
+		}
+	}
+	x.created = nil
+	return first
+}
+
+// mkdir creates the directory entry name.
+func (x *extractor) mkdir(name string, mode os.FileMode, mtime time.Time) error {
+	if err := x.addEntry(); err != nil {
+		return err
+	}
+	target, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("archive entry %q: directory would replace symlink %s", name, target)
+	}
+	// Create the directory with full access; its real permissions are set by
+	// finish, after its contents have been extracted.
+	if missing := firstMissing(target); missing != "" {
+		x.created = append(x.created, missing)
+	}
+	if err := os.MkdirAll(target, 0777); err != nil {
+		return fmt.Errorf("making directory %s: %v", target, err)
+	}
+	x.dirs = append(x.dirs, dirAttrs{path: target, mode: mode & extractedDirModeBits, mtime: mtime})
+	return nil
+}
+
+// writeFile creates the regular file entry name with the contents of r.
+func (x *extractor) writeFile(name string, mode os.FileMode, mtime time.Time, r io.Reader) error {
+	if err := x.addEntry(); err != nil {
+		return err
+	}
+	target, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := x.prepare(target); err != nil {
+		return err
+	}
+	return x.create(name, target, mode, mtime, r)
+}
+
+// create writes the contents of r to target, the new regular file of the
+// entry name, once target has been prepared. It is safe for concurrent use
+// for distinct targets.
+func (x *extractor) create(name, target string, mode os.FileMode, mtime time.Time, r io.Reader) (err error) {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("opening target file %s: %v", target, err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("closing target file %s: %v", target, cerr)
+		}
+	}()
+	if _, err := io.Copy(io.MultiWriter(x, f), r); err != nil {
+		return fmt.Errorf("copying %s to %s: %v", name, target, err)
+	}
+	// Chmod explicitly so that the recorded mode is not subject to umask.
+	if err := f.Chmod(mode & extractedFileModeBits); err != nil {
+		return fmt.Errorf("setting permissions on %s: %v", target, err)
+	}
+	x.mu.Lock()
+	x.numFiles++
+	x.mu.Unlock()
+	return x.chtimes(target, mtime)
+}
+
+// symlink creates the symbolic link entry name pointing to linkname, which
+// must resolve to a location within dest.
+func (x *extractor) symlink(name, linkname string) error {
+	if err := x.addEntry(); err != nil {
+		return err
+	}
+	target, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(linkname) {
+		return fmt.Errorf("archive entry %q: symlink to absolute path %q is not allowed", name, linkname)
+	}
+	if _, err := confine(filepath.Join(filepath.Dir(filepath.FromSlash(name)), linkname)); err != nil {
+		return fmt.Errorf("archive entry %q: symlink to %q: %v", name, linkname, err)
+	}
+	if err := x.prepare(target); err != nil {
+		return err
+	}
+	// The lexical check above does not see through the symlinks extracted
+	// before, e.g. sub -> . makes sub/sub/.. the parent of dest.
+	rel, _ := filepath.Rel(x.dest, filepath.Dir(target))
+	// Join would clean the path lexically, so concatenate instead.
+	if err := x.resolve(filepath.ToSlash(rel) + "/" + linkname); err != nil {
+		return fmt.Errorf("archive entry %q: symlink to %q: %v", name, linkname, err)
+	}
+	if err := os.Symlink(linkname, target); err != nil {
+		return fmt.Errorf("creating symlink %s -> %s: %v", target, linkname, err)
+	}
+	x.numFiles++
+	return nil
+}
+
+// maxSymlinkHops is the number of symlinks that resolve follows, like the
+// limit of the kernel.
+const maxSymlinkHops = 40
+
+// resolve follows the path rel below dest through the symlinks that exist
+// there, and fails if it leads outside of dest at any point. Parent
+// references are only allowed where the path so far is an existing
+// directory, as a symlink extracted later could take the place of anything
+// else.
+func (x *extractor) resolve(rel string) error {
+	var resolved []string
+	pending := strings.Split(filepath.ToSlash(rel), "/")
+	for hops := 0; len(pending) > 0; {
+		c := pending[0]
+		pending = pending[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return fmt.Errorf("path escapes the destination directory through symlinks")
+			}
+			dir := filepath.Join(x.dest, filepath.Join(resolved...))
+			if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+				return fmt.Errorf("path leads to the parent of %s, which is not a directory", filepath.Join(resolved...))
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		path := filepath.Join(x.dest, filepath.Join(resolved...), c)
+		info, err := os.Lstat(path)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, c)
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return fmt.Errorf("path leads through more than %d symlinks", maxSymlinkHops)
+		}
+		link, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("reading symlink %s: %v", path, err)
+		}
+		if filepath.IsAbs(link) {
+			return fmt.Errorf("path leads through symlink %s to absolute path %q", path, link)
+		}
+		pending = append(strings.Split(filepath.ToSlash(link), "/"), pending...)
+	}
+	return nil
+}
+
+// hardlink creates the hard link entry name to the previously extracted
+// entry linkname.
+func (x *extractor) hardlink(name, linkname string) error {
+	if err := x.addEntry(); err != nil {
+		return err
+	}
+	if !x.filter.match(linkname) {
+		return fmt.Errorf("archive entry %s is a hard link to %s, which is not selected for extraction", name, linkname)
+	}
+	target, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	source, err := x.target(linkname)
+	if err != nil {
+		return err
+	}
+	if err := x.prepare(target); err != nil {
+		return err
+	}
+	if err := os.Link(source, target); err != nil {
+		return fmt.Errorf("creating hard link %s to %s: %v", target, linkname, err)
+	}
+	x.numFiles++
+	return nil
+}
+
+// skip handles an entry of a type that cannot be extracted, according to
+// the unsupported entries policy.
+func (x *extractor) skip(name, kind string) error {
+	if err := x.addEntry(); err != nil {
+		return err
+	}
+	switch x.unsupported {
+	case UnsupportedEntriesError:
+		return fmt.Errorf("archive entry %s is a %s, which cannot be extracted", name, kind)
+	case UnsupportedEntriesSkip:
+		return nil
+	default:
+		x.logf("WARNING: skipping archive entry %s: %s is not supported", name, kind)
+		return nil
+	}
+}
+
+func (x *extractor) chtimes(target string, mtime time.Time) error {
+	if mtime.IsZero() {
+		return nil
+	}
+	if err := os.Chtimes(target, mtime, mtime); err != nil {
+		return fmt.Errorf("setting modification time on %s: %v", target, err)
+	}
+	return nil
+}
+
+// finish applies the deferred directory permissions and timestamps. Deeper
+// directories are handled first, so that a parent directory without write or
+// search permission does not prevent updating its children.
+func (x *extractor) finish() error {
+	sort.Slice(x.dirs, func(i, j int) bool { return x.dirs[i].path > x.dirs[j].path })
+	for _, d := range x.dirs {
+		if err := os.Chmod(d.path, d.mode); err != nil {
+			return fmt.Errorf("setting permissions on %s: %v", d.path, err)
+		}
+		if err := x.chtimes(d.path, d.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unzip extracts every selected entry of zipfile.
+func unzip(zipfile string, x *extractor) (err error) {
+	zipReader, err := zip.OpenReader(zipfile)
+	if err != nil {
+		return fmt.Errorf("opening archive %s: %v", zipfile, err)
+	}
+	defer func() {
+		if cerr := zipReader.Close(); cerr != nil {
+			err = fmt.Errorf("closing archive %s: %v", zipfile, cerr)
+		}
+	}()
+
+	var files []*zip.File
+	for _, file := range zipReader.File {
+		if x.selected(file.Name) {
+			files = append(files, file)
+		}
+	}
+
+	// The central directory tells us up front if there are too many entries.
+	if x.maxEntries > 0 && len(files) > x.maxEntries {
+		return fmt.Errorf("archive has %d entries, more than the limit of %d, refusing to extract", len(files), x.maxEntries)
+	}
+
+	extract := unzipSequential
+	if x.workers > 1 && independent(files) {
+		extract = unzipParallel
+	}
+	if err := extract(files, x); err != nil {
+		return err
+	}
+	return x.finish()
+}
+
+// unzipSequential extracts the entries of a zip archive in order.
+func unzipSequential(files []*zip.File, x *extractor) error {
+	for _, file := range files {
+		if err := unzipFile(file, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// independent reports whether the entries of a zip archive can be extracted
+// in any order with the same result: no two of them have the same path, and
+// only directory entries are the parents of others. Otherwise later entries
+// replace earlier ones, or are written through them.
+func independent(files []*zip.File) bool {
+	leaves := map[string]bool{} // Paths of entries other than directories.
+	dirs := map[string]bool{}   // Paths of directory entries and parents.
+	for _, file := range files {
+		rel, err := confine(file.Name)
+		if err != nil {
+			// Let the sequential extraction report it.
+			return false
+		}
+		if leaves[rel] || !file.Mode().IsDir() && dirs[rel] {
+			return false
+		}
+		if file.Mode().IsDir() {
+			dirs[rel] = true
+		} else {
+			leaves[rel] = true
+		}
+		for dir := filepath.Dir(rel); dir != "." && !dirs[dir]; dir = filepath.Dir(dir) {
+			if leaves[dir] {
+				return false
+			}
+			dirs[dir] = true
+		}
+	}
+	return true
+}
+
+// unzipParallel extracts the independent entries of a zip archive, see
+// independent, with x.workers concurrent workers. Everything but the
+// contents of regular files is handled in archive order first: directories,
+// symlinks, skipped entries, and the parent directories of the files, so
+// that the workers only ever create new files in existing directories. If
+// several files fail, the error of the first one in archive order is
+// returned.
+func unzipParallel(files []*zip.File, x *extractor) error {
+	type regular struct {
+		file   *zip.File
+		target string
+	}
+	var regulars []regular
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			if err := unzipFile(file, x); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := x.addEntry(); err != nil {
+			return err
+		}
+		target, err := x.target(file.Name)
+		if err != nil {
+			return err
+		}
+		if err := x.prepare(target); err != nil {
+			return err
+		}
+		regulars = append(regulars, regular{file: file, target: target})
+	}
+
+	errs := make([]error, len(regulars))
+	next := int64(-1)
+	var failed int32
+	var wg sync.WaitGroup
+	for w := 0; w < x.workers && w < len(regulars); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(regulars) || atomic.LoadInt32(&failed) != 0 {
+					return
+				}
+				if err := unzipRegular(regulars[i].file, regulars[i].target, x); err != nil {
+					errs[i] = err
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unzipRegular writes the regular file entry of a zip archive to target,
+// which has been prepared already.
+func unzipRegular(file *zip.File, target string, x *extractor) error {
+	reader, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("opening file %s in archive: %v", file.Name, err)
+	}
+	defer reader.Close()
+	return x.create(file.Name, target, file.Mode(), file.Modified, reader)
+}
+
+// unzipFile extracts a single zip entry, using a func to get early defer
+// calls (important for large numbers of files).
+func unzipFile(file *zip.File, x *extractor) error {
+	mode := file.Mode()
+	switch {
+	case mode.IsDir():
+		return x.mkdir(file.Name, mode, file.Modified)
+	case mode&os.ModeSymlink != 0:
+		// The target of a symlink is stored as the entry's contents.
+		linkname, err := readZipFile(file)
+		if err != nil {
+			return err
+		}
+		return x.symlink(file.Name, string(linkname))
+	case mode.IsRegular():
+		reader, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("opening file %s in archive: %v", file.Name, err)
+		}
+		defer reader.Close()
+		return x.writeFile(file.Name, mode, file.Modified, reader)
+	default:
+		return x.skip(file.Name, fileType(mode))
+	}
+}
+
+func readZipFile(file *zip.File) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("opening file %s in archive: %v", file.Name, err)
+	}
+	defer reader.Close()
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("reading file %s in archive: %v", file.Name, err)
+	}
+	return b, nil
+}
+
+// untarFile extracts every entry of the tar archive file name, which is
+// compressed as understood by decompress.
+func untarFile(name string, decompress decompressor, x *extractor) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("opening archive %s: %v", name, err)
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return fmt.Errorf("decompressing archive %s: %v", name, err)
+	}
+	defer r.Close()
+	return untar(tar.NewReader(r), x)
+}
+
+// untar extracts every selected entry of the tar stream tr.
+func untar(tr *tar.Reader, x *extractor) error {
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar header: %v", err)
+		}
+		if h.Typeflag != tar.TypeXGlobalHeader && !x.selected(h.Name) {
+			continue
+		}
+		mode := h.FileInfo().Mode()
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = x.mkdir(h.Name, mode, h.ModTime)
+		case tar.TypeReg:
+			err = x.writeFile(h.Name, mode, h.ModTime, tr)
+		case tar.TypeSymlink:
+			err = x.symlink(h.Name, h.Linkname)
+		case tar.TypeLink:
+			err = x.hardlink(h.Name, h.Linkname)
+		case tar.TypeXGlobalHeader:
+			// PAX global headers carry no file of their own.
+		default:
+			err = x.skip(h.Name, fileType(mode))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return x.finish()
+}
+
+// fileType describes the type of file for mode, for use in messages.
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "block device"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	default:
+		return "entry of an unsupported type"
+	}
+}
@@ -0,0 +1,713 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var archiveMtime = time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+
+type tarEntry struct {
+	header  tar.Header
+	content string
+}
+
+// buildTar returns a tar stream containing entries.
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := e.header
+		h.Size = int64(len(e.content))
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatalf("Writing header for %s: %v", h.Name, err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("Writing content for %s: %v", h.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+	return &buf
+}
+
+// extractTestDir returns a temp directory to extract into, and a func to
+// remove it again, even if extraction left read-only directories behind.
+func extractTestDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dest, err := ioutil.TempDir("", "gcs-fetcher-extract-")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	return dest, func() {
+		filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(path, 0755)
+			}
+			return nil
+		})
+		if err := os.RemoveAll(dest); err != nil {
+			t.Errorf("Removing temp dir %s: %v", dest, err)
+		}
+	}
+}
+
+var linkTarEntries = []tarEntry{
+	{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0555, ModTime: archiveMtime}},
+	{header: tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0755, ModTime: archiveMtime}, content: "#!/bin/sh"},
+	{header: tar.Header{Name: "bin/link", Typeflag: tar.TypeSymlink, Linkname: "tool"}},
+	{header: tar.Header{Name: "bin/hard", Typeflag: tar.TypeLink, Linkname: "bin/tool"}},
+	{header: tar.Header{Name: "empty/", Typeflag: tar.TypeDir, Mode: 0700}},
+	{header: tar.Header{Name: "nested/deep/file.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: "content"},
+	{header: tar.Header{Name: "pipe", Typeflag: tar.TypeFifo, Mode: 0644}},
+}
+
+func TestUntarLinksAndDirectories(t *testing.T) {
+	dest, teardown := extractTestDir(t)
+	defer teardown()
+
+	x := newExtractor(dest)
+	if err := untar(tar.NewReader(buildTar(t, linkTarEntries)), x); err != nil {
+		t.Fatalf("untar() got %v, want nil", err)
+	}
+	if x.numFiles != 4 {
+		t.Errorf("numFiles got %d, want 4", x.numFiles)
+	}
+
+	for _, c := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"bin", os.ModeDir | 0555},
+		{"bin/tool", 0755},
+		{"bin/link", os.ModeSymlink},
+		{"empty", os.ModeDir | 0700},
+		{"nested/deep/file.txt", 0644},
+	} {
+		info, err := os.Lstat(filepath.Join(dest, c.name))
+		if err != nil {
+			t.Errorf("Lstat(%s) got %v, want nil", c.name, err)
+			continue
+		}
+		got := info.Mode()
+		if c.mode&os.ModeSymlink != 0 {
+			got = got.Type()
+		}
+		if got != c.mode {
+			t.Errorf("%s mode got %v, want %v", c.name, got, c.mode)
+		}
+	}
+
+	if target, err := os.Readlink(filepath.Join(dest, "bin/link")); err != nil || target != "tool" {
+		t.Errorf("Readlink(bin/link) got (%q, %v), want (%q, nil)", target, err, "tool")
+	}
+
+	tool, err := os.Stat(filepath.Join(dest, "bin/tool"))
+	if err != nil {
+		t.Fatalf("Stat(bin/tool) got %v, want nil", err)
+	}
+	hard, err := os.Stat(filepath.Join(dest, "bin/hard"))
+	if err != nil {
+		t.Fatalf("Stat(bin/hard) got %v, want nil", err)
+	}
+	if !os.SameFile(tool, hard) {
+		t.Errorf("bin/hard is not a hard link to bin/tool")
+	}
+
+	for _, name := range []string{"bin", "bin/tool"} {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatalf("Stat(%s) got %v, want nil", name, err)
+		}
+		if !info.ModTime().Equal(archiveMtime) {
+			t.Errorf("%s mtime got %v, want %v", name, info.ModTime(), archiveMtime)
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(dest, "pipe")); !os.IsNotExist(err) {
+		t.Errorf("Lstat(pipe) got %v, want not exists", err)
+	}
+}
+
+func TestUntarStripsSetuid(t *testing.T) {
+	dest, teardown := extractTestDir(t)
+	defer teardown()
+
+	// A setgid and sticky directory, and a setuid and setgid file.
+	entries := []tarEntry{
+		{header: tar.Header{Name: "shared/", Typeflag: tar.TypeDir, Mode: 03777}},
+		{header: tar.Header{Name: "shared/tool", Typeflag: tar.TypeReg, Mode: 06755}, content: "#!/bin/sh"},
+	}
+	x := newExtractor(dest)
+	if err := untar(tar.NewReader(buildTar(t, entries)), x); err != nil {
+		t.Fatalf("untar() got %v, want nil", err)
+	}
+	for _, c := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"shared", os.ModeDir | os.ModeSticky | 0777},
+		{"shared/tool", 0755},
+	} {
+		info, err := os.Lstat(filepath.Join(dest, c.name))
+		if err != nil {
+			t.Errorf("Lstat(%s) got %v, want nil", c.name, err)
+			continue
+		}
+		if got := info.Mode(); got != c.mode {
+			t.Errorf("%s mode got %v, want %v", c.name, got, c.mode)
+		}
+	}
+}
+
+func TestUntarUnsupportedEntries(t *testing.T) {
+	for _, c := range []struct {
+		policy  string
+		wantErr bool
+	}{
+		{UnsupportedEntriesError, true},
+		{UnsupportedEntriesWarn, false},
+		{UnsupportedEntriesSkip, false},
+	} {
+		t.Run(c.policy, func(t *testing.T) {
+			dest, teardown := extractTestDir(t)
+			defer teardown()
+
+			var warnings []string
+			x := newExtractor(dest)
+			x.unsupported = c.policy
+			x.logf = func(format string, a ...interface{}) { warnings = append(warnings, format) }
+
+			err := untar(tar.NewReader(buildTar(t, linkTarEntries)), x)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("untar() got %v, wantErr %t", err, c.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "pipe is a fifo") {
+				t.Errorf("untar() got %v, want error naming the fifo", err)
+			}
+			if wantWarnings := c.policy == UnsupportedEntriesWarn; (len(warnings) > 0) != wantWarnings {
+				t.Errorf("untar() warnings got %v, want warnings %t", warnings, wantWarnings)
+			}
+		})
+	}
+}
+
+func TestUnzipSymlink(t *testing.T) {
+	dest, teardown := extractTestDir(t)
+	defer teardown()
+
+	zipfile := filepath.Join(dest, "source.zip")
+	f, err := os.Create(zipfile)
+	if err != nil {
+		t.Fatalf("Creating zipfile: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	for _, e := range []struct {
+		name, content string
+		mode          os.FileMode
+	}{
+		{"out/target.txt", "content", 0644},
+		{"out/link", "target.txt", os.ModeSymlink | 0777},
+	} {
+		fh := &zip.FileHeader{Name: e.name, Modified: archiveMtime}
+		fh.SetMode(e.mode)
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatalf("Creating entry %s: %v", e.name, err)
+		}
+		if _, err := w.Write([]byte(e.content)); err != nil {
+			t.Fatalf("Writing entry %s: %v", e.name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Closing zip writer: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Closing zipfile: %v", err)
+	}
+
+	if err := unzip(zipfile, newExtractor(dest)); err != nil {
+		t.Fatalf("unzip() got %v, want nil", err)
+	}
+	link := filepath.Join(dest, "out/link")
+	if target, err := os.Readlink(link); err != nil || target != "target.txt" {
+		t.Errorf("Readlink(%s) got (%q, %v), want (%q, nil)", link, target, err, "target.txt")
+	}
+	if b, err := ioutil.ReadFile(link); err != nil || string(b) != "content" {
+		t.Errorf("ReadFile(%s) got (%q, %v), want (%q, nil)", link, b, err, "content")
+	}
+	info, err := os.Stat(filepath.Join(dest, "out/target.txt"))
+	if err != nil {
+		t.Fatalf("Stat(out/target.txt) got %v, want nil", err)
+	}
+	if !info.ModTime().Equal(archiveMtime) {
+		t.Errorf("out/target.txt mtime got %v, want %v", info.ModTime(), archiveMtime)
+	}
+}
+
+func TestUntarRejectsEscapingEntries(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		entries []tarEntry
+	}{{
+		name:    "parent traversal",
+		entries: []tarEntry{{header: tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "x"}},
+	}, {
+		name:    "nested parent traversal",
+		entries: []tarEntry{{header: tar.Header{Name: "a/../../evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "x"}},
+	}, {
+		name:    "absolute path",
+		entries: []tarEntry{{header: tar.Header{Name: "/tmp/evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "x"}},
+	}, {
+		name:    "absolute directory",
+		entries: []tarEntry{{header: tar.Header{Name: "/tmp/evil/", Typeflag: tar.TypeDir, Mode: 0755}}},
+	}, {
+		name:    "symlink to parent",
+		entries: []tarEntry{{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../.."}}},
+	}, {
+		name:    "symlink to absolute path",
+		entries: []tarEntry{{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}},
+	}, {
+		name: "write through symlink",
+		entries: []tarEntry{
+			{header: tar.Header{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "sub"}},
+			{header: tar.Header{Name: "link/evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "x"},
+		},
+	}, {
+		name: "chained symlinks",
+		entries: []tarEntry{
+			{header: tar.Header{Name: "sub", Typeflag: tar.TypeSymlink, Linkname: "."}},
+			{header: tar.Header{Name: "esc", Typeflag: tar.TypeSymlink, Linkname: "sub/sub/.."}},
+		},
+	}, {
+		name: "symlink through a later symlink",
+		entries: []tarEntry{
+			{header: tar.Header{Name: "esc", Typeflag: tar.TypeSymlink, Linkname: "later/.."}},
+			{header: tar.Header{Name: "loop", Typeflag: tar.TypeSymlink, Linkname: "."}},
+			{header: tar.Header{Name: "later", Typeflag: tar.TypeSymlink, Linkname: "loop"}},
+		},
+	}, {
+		name:    "hardlink outside",
+		entries: []tarEntry{{header: tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../outside"}}},
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			root, teardown := extractTestDir(t)
+			defer teardown()
+			// Extract into a subdirectory so that escapes would land in root.
+			dest := filepath.Join(root, "dest", "sub")
+			if err := os.MkdirAll(dest, 0777); err != nil {
+				t.Fatalf("Creating dest: %v", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(root, "dest", "outside"), []byte("outside"), 0644); err != nil {
+				t.Fatalf("Creating outside file: %v", err)
+			}
+
+			if err := untar(tar.NewReader(buildTar(t, c.entries)), newExtractor(dest)); err == nil {
+				t.Fatalf("untar() got nil, want error")
+			}
+			for _, name := range []string{"evil", "dest/evil", "dest/hard", "dest/sub/esc", "tmp"} {
+				if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+					t.Errorf("%s was written outside of the destination", name)
+				}
+			}
+		})
+	}
+}
+
+func TestUntarLimits(t *testing.T) {
+	big := strings.Repeat("a", 2*ratioCheckMinBytes)
+	entries := []tarEntry{
+		{header: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "dir/big", Typeflag: tar.TypeReg, Mode: 0644}, content: big},
+	}
+	for _, c := range []struct {
+		name    string
+		limit   func(x *extractor)
+		wantErr string
+	}{
+		{"no limits", func(x *extractor) {}, ""},
+		{"bytes", func(x *extractor) { x.maxBytes = int64(len(big)) - 1 }, "more than"},
+		{"bytes within limit", func(x *extractor) { x.maxBytes = int64(len(big)) }, ""},
+		{"entries", func(x *extractor) { x.maxEntries = 1 }, "more than 1 entries"},
+		{"ratio", func(x *extractor) {
+			x.maxRatio = 100
+			x.compressed = func() int64 { return 1000 }
+		}, "times its compressed size"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dest, teardown := extractTestDir(t)
+			defer teardown()
+
+			x := newExtractor(dest)
+			c.limit(x)
+			err := untar(tar.NewReader(buildTar(t, entries)), x)
+			if c.wantErr == "" {
+				if err != nil {
+					t.Errorf("untar() got %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("untar() got %v, want error containing %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+// tarBz2Contents is a bzip2 compressed tar archive holding dir/file.txt, as
+// there is no bzip2 compressor in the standard library.
+const tarBz2Contents = "QlpoOTFBWSZTWVosEOYAAHR7gMoAEABAAf2ABABvZZ9ACAggAHQaiZHpBpoyNBkPKCShNNAGgAAPupxqEDXIQh3NkpGQegQxMMs4VPmi0IMASsA1DI4tg20ODikTmEwQR7840Mp9d70rh7d41ZoaLNChNSlAfi7kinChILRYIcw="
+
+const archivedContent = "archived content"
+
+// buildArchive returns an archive of the given source type holding
+// dir/file.txt.
+func buildArchive(t *testing.T, sourceType string) []byte {
+	t.Helper()
+	tarball := buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "dir/file.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: archivedContent},
+	}).Bytes()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch sourceType {
+	case "TarArchive":
+		return tarball
+	case "TarBz2Archive":
+		b, err := base64.StdEncoding.DecodeString(tarBz2Contents)
+		if err != nil {
+			t.Fatalf("Decoding bzip2 archive: %v", err)
+		}
+		return b
+	case "ZipArchive":
+		zw := zip.NewWriter(&buf)
+		f, err := zw.Create("dir/file.txt")
+		if err != nil {
+			t.Fatalf("Creating zip entry: %v", err)
+		}
+		if _, err := f.Write([]byte(archivedContent)); err != nil {
+			t.Fatalf("Writing zip entry: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Closing zip writer: %v", err)
+		}
+		return buf.Bytes()
+	case "TarGzArchive":
+		w = gzip.NewWriter(&buf)
+	case "TarZstdArchive":
+		w, err = zstd.NewWriter(&buf)
+	case "TarXzArchive":
+		w, err = xz.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown source type %q", sourceType)
+	}
+	if err != nil {
+		t.Fatalf("Creating %s compressor: %v", sourceType, err)
+	}
+	if _, err := w.Write(tarball); err != nil {
+		t.Fatalf("Compressing %s: %v", sourceType, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Closing %s compressor: %v", sourceType, err)
+	}
+	return buf.Bytes()
+}
+
+func TestSniffArchiveType(t *testing.T) {
+	for _, sourceType := range []string{"ZipArchive", "TarArchive", "TarGzArchive", "TarZstdArchive", "TarXzArchive", "TarBz2Archive"} {
+		if got := sniffArchiveType(buildArchive(t, sourceType)); got != sourceType {
+			t.Errorf("sniffArchiveType(%s) got %q, want %q", sourceType, got, sourceType)
+		}
+	}
+	for _, header := range []string{"", "{\"manifest\": true}", "plain text"} {
+		if got := sniffArchiveType([]byte(header)); got != "" {
+			t.Errorf("sniffArchiveType(%q) got %q, want \"\"", header, got)
+		}
+	}
+}
+
+func TestFetchFromArchive(t *testing.T) {
+	for _, sourceType := range []string{"ZipArchive", "TarArchive", "TarGzArchive", "TarZstdArchive", "TarXzArchive", "TarBz2Archive"} {
+		for _, requested := range []string{sourceType, "Auto"} {
+			for _, stream := range []bool{false, true} {
+				name := sourceType + "/" + requested
+				if stream {
+					name += "/stream"
+				}
+				t.Run(name, func(t *testing.T) {
+					tc, teardown := buildTestContext(t)
+					defer teardown()
+
+					object := "source-" + sourceType
+					tc.gcs.objects[formatGCSName(successBucket, object, generation)] = fakeGCSResponse{content: buildArchive(t, sourceType)}
+					tc.gf.Object = object
+					tc.gf.SourceType = requested
+					tc.gf.Stream = stream
+
+					if err := tc.gf.Fetch(context.Background()); err != nil {
+						t.Fatalf("Fetch() got %v, want nil", err)
+					}
+					name := filepath.Join(tc.gf.DestDir, "dir/file.txt")
+					if b, err := ioutil.ReadFile(name); err != nil || string(b) != archivedContent {
+						t.Errorf("ReadFile(%s) got (%q, %v), want (%q, nil)", name, b, err, archivedContent)
+					}
+					if _, err := os.Stat(tc.gf.StagingDir); !os.IsNotExist(err) {
+						t.Errorf("Stat(%s) got %v, want not exist", tc.gf.StagingDir, err)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestFetchFromArchiveSummary(t *testing.T) {
+	for _, c := range []struct {
+		sourceType string
+		want       []string
+	}{
+		{"ZipArchive", []string{"Time for zipfile:  ", "Time to unzip:     "}},
+		{"TarGzArchive", []string{"Time for tgzfile:  ", "Time to untgz:     "}},
+		{"TarZstdArchive", []string{"Time for archive:  ", "Time to extract:   "}},
+	} {
+		t.Run(c.sourceType, func(t *testing.T) {
+			tc, teardown := buildTestContext(t)
+			defer teardown()
+
+			var log bytes.Buffer
+			tc.gf.Stdout = &log
+			object := "source-" + c.sourceType
+			tc.gcs.objects[formatGCSName(successBucket, object, generation)] = fakeGCSResponse{content: buildArchive(t, c.sourceType)}
+			tc.gf.Object = object
+			tc.gf.SourceType = c.sourceType
+
+			if err := tc.gf.Fetch(context.Background()); err != nil {
+				t.Fatalf("Fetch() got %v, want nil", err)
+			}
+			for _, want := range c.want {
+				if !strings.Contains(log.String(), want) {
+					t.Errorf("Fetch() summary got:\n%s\nwant %q", log.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchFromArchiveAutoUnknownType(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	tc.gf.Object = sfile1
+	tc.gf.SourceType = "Auto"
+
+	err := tc.gf.Fetch(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "cannot detect the archive type") {
+		t.Errorf("Fetch() got %v, want error containing %q", err, "cannot detect the archive type")
+	}
+}
+
+type zipEntry struct {
+	name, content string
+	mode          os.FileMode
+}
+
+// writeZip writes a zip archive containing entries to name.
+func writeZip(t *testing.T, name string, entries []zipEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.name, Modified: archiveMtime, Method: zip.Deflate}
+		fh.SetMode(e.mode)
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatalf("Creating entry %s: %v", e.name, err)
+		}
+		if _, err := w.Write([]byte(e.content)); err != nil {
+			t.Fatalf("Writing entry %s: %v", e.name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Closing zip writer: %v", err)
+	}
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Writing zipfile: %v", err)
+	}
+}
+
+// extractedTree describes every path below dest by its mode, and the mtime
+// and contents of files or the target of links. The mtimes of directories
+// are left out, as implicit ones are created at the time of extraction.
+func extractedTree(t *testing.T, dest string) map[string]string {
+	t.Helper()
+	tree := map[string]string{}
+	filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatalf("Walking %s: %v", path, err)
+		}
+		rel, _ := filepath.Rel(dest, path)
+		desc := fmt.Sprintf("%v", info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			desc += " -> " + target
+		case info.Mode().IsRegular():
+			b, _ := ioutil.ReadFile(path)
+			desc += fmt.Sprintf(" %v %q", info.ModTime().UTC(), b)
+		}
+		tree[rel] = desc
+		return nil
+	})
+	return tree
+}
+
+func TestIndependent(t *testing.T) {
+	for _, c := range []struct {
+		desc    string
+		entries []zipEntry
+		want    bool
+	}{
+		{"files and directories", []zipEntry{{name: "a/", mode: os.ModeDir | 0755}, {name: "a/b/c"}, {name: "a/b/d"}, {name: "a/b/", mode: os.ModeDir | 0555}}, true},
+		{"duplicate file", []zipEntry{{name: "a/b"}, {name: "a/./b"}}, false},
+		{"file replaced by directory", []zipEntry{{name: "a"}, {name: "a/", mode: os.ModeDir | 0755}}, false},
+		{"directory replaced by file", []zipEntry{{name: "a/b"}, {name: "a"}}, false},
+		{"file under a file", []zipEntry{{name: "a"}, {name: "a/b"}}, false},
+		{"file under a symlink", []zipEntry{{name: "a", mode: os.ModeSymlink | 0777}, {name: "a/b"}}, false},
+		{"escaping entry", []zipEntry{{name: "../a"}}, false},
+	} {
+		var files []*zip.File
+		for _, e := range c.entries {
+			fh := &zip.FileHeader{Name: e.name}
+			fh.SetMode(e.mode)
+			files = append(files, &zip.File{FileHeader: *fh})
+		}
+		if got := independent(files); got != c.want {
+			t.Errorf("independent(%s) got %t, want %t", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestUnzipParallel(t *testing.T) {
+	dir, cleanup := extractTestDir(t)
+	defer cleanup()
+
+	entries := []zipEntry{
+		{name: "ro/", mode: os.ModeDir | 0555},
+		{name: "ro/file", content: "read-only dir", mode: 0644},
+		{name: "ro/implicit/file", content: "implicit parent", mode: 0600},
+		{name: "pipe", mode: os.ModeNamedPipe | 0644},
+	}
+	for i := 0; i < 200; i++ {
+		entries = append(entries, zipEntry{name: fmt.Sprintf("many/%d/%03d.txt", i%7, i), content: strings.Repeat("x", i), mode: 0644})
+	}
+	entries = append(entries, zipEntry{name: "many/link", content: "0/000.txt", mode: os.ModeSymlink | 0777})
+	zipfile := filepath.Join(dir, "test.zip")
+	writeZip(t, zipfile, entries)
+
+	sequential := newExtractor(filepath.Join(dir, "sequential"))
+	sequential.unsupported = UnsupportedEntriesSkip
+	if err := unzip(zipfile, sequential); err != nil {
+		t.Fatalf("unzip() got %v, want nil", err)
+	}
+	parallel := newExtractor(filepath.Join(dir, "parallel"))
+	parallel.unsupported = UnsupportedEntriesSkip
+	parallel.workers = 8
+	if err := unzip(zipfile, parallel); err != nil {
+		t.Fatalf("unzip() with 8 workers got %v, want nil", err)
+	}
+
+	want := extractedTree(t, sequential.dest)
+	got := extractedTree(t, parallel.dest)
+	if len(want) != 200+14 {
+		t.Errorf("unzip() extracted %d paths, want %d", len(want), 200+14)
+	}
+	for path, w := range want {
+		if got[path] != w {
+			t.Errorf("unzip() with 8 workers extracted %s as %q, want %q", path, got[path], w)
+		}
+	}
+	for path, g := range got {
+		if _, ok := want[path]; !ok {
+			t.Errorf("unzip() with 8 workers extracted %s as %q, want nothing", path, g)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(parallel.dest, "ro")); err != nil || !info.ModTime().Equal(archiveMtime) {
+		t.Errorf("unzip() with 8 workers set the mtime of ro to %v (%v), want %v", info.ModTime(), err, archiveMtime)
+	}
+	if parallel.numFiles != sequential.numFiles || parallel.entries != sequential.entries || parallel.written != sequential.written {
+		t.Errorf("unzip() with 8 workers got %d files, %d entries and %d bytes, want %d, %d and %d", parallel.numFiles, parallel.entries, parallel.written, sequential.numFiles, sequential.entries, sequential.written)
+	}
+}
+
+func TestUnzipParallelFallsBack(t *testing.T) {
+	dir, cleanup := extractTestDir(t)
+	defer cleanup()
+
+	// A later entry replaces an earlier one of the same name.
+	zipfile := filepath.Join(dir, "test.zip")
+	writeZip(t, zipfile, []zipEntry{
+		{name: "file", content: "first", mode: 0644},
+		{name: "other", content: "other", mode: 0644},
+		{name: "file", content: "second", mode: 0644},
+	})
+	x := newExtractor(filepath.Join(dir, "out"))
+	x.workers = 8
+	if err := unzip(zipfile, x); err != nil {
+		t.Fatalf("unzip() got %v, want nil", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(x.dest, "file")); err != nil || string(b) != "second" {
+		t.Errorf("unzip() wrote file %q (%v), want %q", b, err, "second")
+	}
+}
+
+func TestUnzipParallelLimits(t *testing.T) {
+	dir, cleanup := extractTestDir(t)
+	defer cleanup()
+
+	var entries []zipEntry
+	for i := 0; i < 50; i++ {
+		entries = append(entries, zipEntry{name: fmt.Sprintf("%02d", i), content: "0123456789", mode: 0644})
+	}
+	zipfile := filepath.Join(dir, "test.zip")
+	writeZip(t, zipfile, entries)
+	x := newExtractor(filepath.Join(dir, "out"))
+	x.workers = 8
+	x.maxBytes = 100
+	if err := unzip(zipfile, x); err == nil || !strings.Contains(err.Error(), "refusing to extract") {
+		t.Errorf("unzip() got %v, want size limit error", err)
+	}
+}
@@ -16,28 +16,26 @@ limitations under the License.
 package fetcher
 
 import (
-	"archive/tar"
-	"archive/zip"
-	"compress/gzip"
 	"context"
-	"crypto/sha1"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
-	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+	"cloud.google.com/go/storage"
 	"google.golang.org/api/googleapi"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
 )
 
 var (
@@ -70,8 +68,13 @@ var (
 	robotRegex  = regexp.MustCompile(`<Details>(\S+@\S+)\s`)
 	nonHexRegex = regexp.MustCompile(`[^0-9a-f]`)
 
-	errorExitStatus            = 1
-	permissionDeniedExitStatus = 3
+	// defaultFileMode is applied to fetched files when the manifest does not
+	// record a mode, e.g. manifests written by older uploaders.
+	defaultFileMode = os.FileMode(0555)
+
+	// restorableModeBits are the bits of a recorded mode that are applied to
+	// a fetched file; file type bits are never restored.
+	restorableModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
 )
 
 type sizeBytes int64
@@ -82,7 +85,46 @@ type job struct {
 	bucket, object  string
 	generation      int64
 	sha1sum         string
+	sha256sum       string
 	destDirOverride string
+	mode            os.FileMode // Mode to apply to the fetched file; zero means defaultFileMode.
+	mtime           time.Time   // Modification time to apply to the fetched file, if non-zero.
+	size            int64       // Size of the object, if known; used to derive timeouts.
+
+	// attrs are the attributes of the object, if known; the download is
+	// verified against their checksums.
+	attrs *ObjectAttrs
+
+	// awaitVisible retries permission and not-found errors like transient
+	// ones, for an object that may not be visible yet.
+	awaitVisible bool
+
+	// sliceOf is set for a slice of a sliced download: the job fetches the
+	// length bytes at offset into the existing file sliceOf, see fetchSliced.
+	sliceOf        string
+	offset, length int64
+
+	// resumeFrom is set to resume a failed download: the job fetches the
+	// object from that offset on, into the partial temp file of the failed
+	// attempt, see resumable.
+	resumeFrom int64
+
+	// copyOf is set for a manifest entry with the same contents as the entry
+	// copyOf, which is fetched instead; the job copies that file once it is in
+	// place, see dedupe.
+	copyOf string
+
+	// transfer counts the bytes of the download in flight towards the
+	// progress of the fetch, see startProgress.
+	transfer *transfer
+}
+
+// fileMode returns the mode that should be applied to the fetched file.
+func (j job) fileMode() os.FileMode {
+	if mode := j.mode & restorableModeBits; mode != 0 {
+		return mode
+	}
+	return defaultFileMode
 }
 
 // jobAttempt is an attempt to download a particular file, may result in
@@ -91,6 +133,7 @@ type jobAttempt struct {
 	started    time.Time
 	duration   time.Duration
 	err        error
+	class      errorClass // Class of err, if set.
 	gcsTimeout time.Duration
 }
 
@@ -105,11 +148,18 @@ type jobReport struct {
 	success   bool
 	finalname string
 	err       error
+	cached    sizeBytes // Size of the file if it was taken from the destination or the cache instead of GCS.
+	copied    sizeBytes // Size of the file if it was copied from a duplicate entry.
 }
 
 type fetchOnceResult struct {
 	size sizeBytes
 	err  error
+
+	// partial is the number of bytes left in the temp file by a failed
+	// download that can be resumed, see resumable. Zero if the file was
+	// removed.
+	partial int64
 }
 
 type stats struct {
@@ -117,10 +167,53 @@ type stats struct {
 	files       int
 	size        sizeBytes
 	duration    time.Duration
+	busy        time.Duration // Time spent by all workers on the files.
 	retries     int
 	gcsTimeouts int
-	success     bool
-	errs        []error
+
+	// Retries by the class of the error that caused them, and files that
+	// failed with a permanent error.
+	transientRetries  int
+	throttledRetries  int
+	permanentFailures int
+
+	cacheHits  int
+	cached     sizeBytes
+	duplicates int
+	logical    sizeBytes // Size of all the files, however they were fetched.
+	success    bool
+	errs       []error
+
+	// reports are the reports of all the files, which are only kept for a
+	// gf.ReportWriter; slowestReports those of the slowest files.
+	reports        []jobReport
+	slowestReports slowestQueue
+}
+
+// add adds the statistics of the jobs o, processed after those of s.
+func (s *stats) add(o stats) {
+	if o.workers > s.workers {
+		s.workers = o.workers
+	}
+	s.files += o.files
+	s.size += o.size
+	s.duration += o.duration
+	s.busy += o.busy
+	s.retries += o.retries
+	s.gcsTimeouts += o.gcsTimeouts
+	s.transientRetries += o.transientRetries
+	s.throttledRetries += o.throttledRetries
+	s.permanentFailures += o.permanentFailures
+	s.cacheHits += o.cacheHits
+	s.cached += o.cached
+	s.duplicates += o.duplicates
+	s.logical += o.logical
+	s.success = s.success && o.success
+	s.errs = append(s.errs, o.errs...)
+	s.reports = append(s.reports, o.reports...)
+	for _, report := range o.slowestReports {
+		s.slowestReports.add(report)
+	}
 }
 
 // OS allows us to inject dependencies to facilitate testing.
@@ -130,12 +223,17 @@ type OS interface {
 	Create(name string) (*os.File, error)
 	MkdirAll(path string, perm os.FileMode) error
 	Open(name string) (*os.File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
 	RemoveAll(path string) error
+	Chtimes(name string, atime, mtime time.Time) error
 }
 
 // GCS allows us to inject dependencies to facilitate testing.
 type GCS interface {
-	NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, error)
+	// NewReader returns a reader for the object. If generation is non-zero,
+	// the reader must serve exactly that generation of the object rather than
+	// the live one.
+	NewReader(ctx context.Context, bucket, object string, generation int64) (io.ReadCloser, error)
 }
 
 // Fetcher is the main workhorse of this package and does all the heavy lifting.
@@ -147,30 +245,115 @@ type Fetcher struct {
 	KeepSource bool
 	StagingDir string
 
+	// CacheDir is a local cache of manifest files, keyed by their SHA1
+	// checksum. Files are taken from the cache rather than GCS if possible,
+	// and fetched files are added to it. Empty means no cache.
+	CacheDir string
+
 	// mu guards CreatedDirs
 	mu          sync.Mutex
 	CreatedDirs map[string]bool
 
+	// seq numbers temp files, see tempSeq.
+	seq uint32
+
+	// throughput is observed on downloads to derive timeouts.
+	throughput throughput
+
+	// attrsWarning logs the first failure to get object attributes, see
+	// fetchAttrs.
+	attrsWarning sync.Once
+
 	SourceType     string
 	Bucket, Object string
 	Generation     int64
 
+	// UnsupportedEntries is the policy for archive entries that cannot be
+	// extracted, such as device nodes and fifos: one of
+	// UnsupportedEntriesError, UnsupportedEntriesWarn (the default) or
+	// UnsupportedEntriesSkip.
+	UnsupportedEntries string
+
+	// MaxExtractBytes, MaxExtractEntries and MaxCompressionRatio limit the
+	// total number of bytes extracted from an archive, the number of entries
+	// in it, and the ratio of extracted bytes to the archive's size, to
+	// protect against decompression bombs. Zero means unlimited.
+	MaxExtractBytes     int64
+	MaxExtractEntries   int
+	MaxCompressionRatio float64
+
+	// SliceThreshold is the size from which archives are downloaded in
+	// slices, using up to WorkerCount concurrent ranged reads. Zero disables
+	// sliced downloads, as does a GCS that does not implement RangeGCS.
+	SliceThreshold int64
+
+	// Include and Exclude select the manifest entries or archive entries to
+	// fetch by their path, see pathFilter. By default, all are fetched.
+	Include, Exclude []string
+
+	// filter is the pathFilter for Include and Exclude.
+	filter *pathFilter
+
+	// RequireChecksums fails files that cannot be verified, because neither
+	// the manifest nor the object's attributes have a checksum for them.
+	RequireChecksums bool
+
+	// Verify compares the files in DestDir against a manifest instead of
+	// fetching them, and fails with a DriftError if they do not match.
+	Verify bool
+
+	// Stream extracts tar-based archives while they are being downloaded,
+	// rather than staging them in StagingDir first. It has no effect if
+	// KeepSource is set.
+	Stream bool
+
 	TimeoutGCS  bool
 	WorkerCount int
 	Retries     int
 	Backoff     time.Duration
 	Verbose     bool
-	Stdout      io.Writer
-	Stderr      io.Writer
-}
 
-type permissionError struct {
-	bucket string
-	robot  string
+	// MaxBackoff caps the time to wait between retries. Zero means no cap.
+	MaxBackoff time.Duration
+
+	// MaxBytesPerSecond limits the total rate of all downloads, and
+	// MaxPerBucket the number of concurrent downloads from each bucket.
+	// Zero means unlimited.
+	MaxBytesPerSecond int64
+	MaxPerBucket      int
+
+	// limits enforces MaxBytesPerSecond and MaxPerBucket during a fetch.
+	limits *limits
+
+	// ProgressInterval is the time between progress reports of a fetch,
+	// which are logged and added to its Report. Zero means no reports.
+	ProgressInterval time.Duration
+
+	// progress tracks the progress of the current fetch.
+	progress *progress
+
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// ReportWriter, if set, receives a JSON Report of every fetch, whether
+	// it succeeded or not.
+	ReportWriter io.Writer
+
+	// report is the Report of the current fetch.
+	report *Report
 }
 
-func (e *permissionError) Error() string {
-	return fmt.Sprintf("Access to bucket %s denied. You must grant Storage Object Viewer permission to %s. If you are using VPC Service Controls, you must also grant it access to your service perimeter.", e.bucket, e.robot)
+// isNotFound reports whether err indicates that the requested object (or
+// object generation) does not exist.
+func isNotFound(err error) bool {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return true
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	code, ok := httpStatus(err)
+	return ok && code == http.StatusNotFound
 }
 
 func logit(writer io.Writer, format string, a ...interface{}) {
@@ -192,13 +375,17 @@ func (gf *Fetcher) recordFailure(j job, started time.Time, gcsTimeout time.Durat
 		started:    started,
 		duration:   time.Since(started),
 		err:        err,
+		class:      classify(err),
 		gcsTimeout: gcsTimeout,
 	}
 	report.success = false
 	report.err = err // Hold the latest error.
 	report.attempts = append(report.attempts, attempt)
 
-	isLast := len(report.attempts) == gf.Retries
+	isLast := len(report.attempts) == gf.Retries || !retryable(j, attempt.class)
+	if !isLast {
+		gf.progress.retry()
+	}
 	if gf.Verbose || isLast {
 		retryMsg := ", will retry"
 		if isLast {
@@ -232,54 +419,105 @@ func (gf *Fetcher) recordSuccess(j job, started time.Time, size sizeBytes, final
 // from GCS. It first downloads the file to a temp file, then renames it to
 // the final location and sets the permissions on the final file.
 func (gf *Fetcher) fetchObject(ctx context.Context, j job) *jobReport {
-	report := &jobReport{job: j, started: time.Now()}
+	started := time.Now()
+	j.transfer = gf.progress.start(j)
+	report := &jobReport{job: j, started: started}
 	defer func() {
 		report.completed = time.Now()
+		gf.progress.finish(j.transfer, report)
 	}()
+	// Files without a checksum in the manifest are verified against the
+	// checksums of their object attributes, which the first attempt gets.
+	// Their timeouts then use the size in them too, if the manifest has none.
+	needAttrs := j.attrs == nil && j.sliceOf == "" && j.sha1sum == "" && j.sha256sum == ""
+	if gf.RequireChecksums && j.sliceOf == "" && !needAttrs && !verifiable(j) {
+		gf.recordFailure(j, started, noTimeout, &UnverifiableError{JobInfo: j.info()}, report)
+		return report
+	}
 
 	var tmpfile string
-	var backoff time.Duration
+	var resumeFrom int64
 
-	// Within a manifest, multiple files may have the same SHA. This can lead
-	// to a race condition within the goworkers that are downloading the files
-	// concurrently. To mitigate this issue, we add some randomness to the name
-	// of the temp file being pulled.
-	fuzz := rand.Intn(999999)
+	// Number the temp file, so that concurrent downloads of the same object
+	// never share one.
+	seq := gf.tempSeq()
 
 	for retrynum := 0; retrynum <= gf.Retries; retrynum++ {
-		// Apply appropriate retry backoff.
+		// Apply appropriate retry backoff, unless retrying is futile.
 		if retrynum > 0 {
-			if retrynum == 1 {
-				backoff = gf.Backoff
-			} else {
-				backoff *= 2
+			class := report.attempts[len(report.attempts)-1].class
+			if !retryable(j, class) {
+				break
 			}
-			time.Sleep(backoff)
+			sleep(ctx, gf.retryBackoff(retrynum, class))
 		}
 
 		started := time.Now()
 
-		// Download to temp location [DestDir]/[StagingDir]/[Bucket]-[Object]-[fuzz]-[retry]
-		// If fetchObjectOnceWithTimeout() times out, this file will be orphaned and we can
-		// clean it up later.
-		tmpfile = filepath.Join(gf.StagingDir, fmt.Sprintf("%s-%s-%d-%d", j.bucket, j.object, fuzz, retrynum))
-		if err := gf.ensureFolders(tmpfile); err != nil {
-			e := fmt.Errorf("creating folders for temp file %q: %v", tmpfile, err)
+		// Download to temp location [DestDir]/[StagingDir]/[Bucket]-[Object]-[seq]-[retry]
+		// If fetchObjectOnceWithTimeout() times out, the attempt removes this file
+		// once its reader has been cancelled, unless the download is resumable.
+		// A resumed download continues the temp file of the failed attempt instead.
+		if resumeFrom == 0 {
+			tmpfile = filepath.Join(gf.StagingDir, fmt.Sprintf("%s-%s-%d-%d", j.bucket, j.object, seq, retrynum))
+		}
+		if j.sliceOf != "" {
+			// Slices are written straight into the file being assembled.
+			tmpfile = j.sliceOf
+		} else if err := gf.ensureFolders(tmpfile); err != nil {
+			e := fmt.Errorf("creating folders for temp file %q: %w", tmpfile, err)
 			gf.recordFailure(j, started, noTimeout, e, report)
 			continue
 		}
 
-		allowedGCSTimeout := gf.timeout(j.filename, retrynum)
-		size, err := gf.fetchObjectOnceWithTimeout(ctx, j, allowedGCSTimeout, tmpfile)
+		release, err := gf.limits.acquire(ctx, j.bucket)
 		if err != nil {
-			// Allow permissionError to bubble up.
+			gf.recordFailure(j, started, noTimeout, err, report)
+			continue
+		}
+		started = time.Now() // Waiting for the bucket is not part of the attempt.
+		allowedGCSTimeout := gf.timeout(j, retrynum)
+		if needAttrs {
+			if err := gf.fetchAttrs(ctx, &j, allowedGCSTimeout); err != nil {
+				release()
+				gf.recordFailure(j, started, allowedGCSTimeout, err, report)
+				continue
+			}
+			needAttrs = false
+			report.job = j
+			allowedGCSTimeout = gf.timeout(j, retrynum)
+			if gf.RequireChecksums && !verifiable(j) {
+				release()
+				gf.recordFailure(j, started, noTimeout, &UnverifiableError{JobInfo: j.info()}, report)
+				break
+			}
+		}
+		j.transfer.restart()
+		attempt := j
+		attempt.resumeFrom = resumeFrom
+		if resumeFrom > 0 {
+			gf.log("Resuming download of %s at byte %d of %d", formatGCSName(j.bucket, j.object, j.generation), resumeFrom, j.size)
+		}
+		result := gf.fetchObjectOnceWithTimeout(ctx, attempt, allowedGCSTimeout, tmpfile)
+		release()
+		size, err := result.size, result.err
+		resumeFrom = result.partial
+		if err != nil {
+			// Allow PermissionError and NotFoundError to bubble up.
 			e := err
-			if _, ok := err.(*permissionError); !ok {
-				e = fmt.Errorf("fetching %q with timeout %v to temp file %q: %v", formatGCSName(j.bucket, j.object, j.generation), allowedGCSTimeout, tmpfile, err)
+			switch err.(type) {
+			case *PermissionError, *NotFoundError:
+			default:
+				e = fmt.Errorf("fetching %q with timeout %v to temp file %q: %w", formatGCSName(j.bucket, j.object, j.generation), allowedGCSTimeout, tmpfile, err)
 			}
 			gf.recordFailure(j, started, allowedGCSTimeout, e, report)
 			continue
 		}
+		gf.throughput.add(size-sizeBytes(attempt.resumeFrom), time.Since(started))
+		if j.sliceOf != "" {
+			gf.recordSuccess(j, started, size, j.sliceOf, report)
+			break
+		}
 
 		// Rename the temp file to the final filename
 		dest := gf.DestDir
@@ -288,31 +526,41 @@ func (gf *Fetcher) fetchObject(ctx context.Context, j job) *jobReport {
 		}
 		finalname := filepath.Join(dest, j.filename)
 		if err := gf.ensureFolders(finalname); err != nil {
-			e := fmt.Errorf("creating folders for final file %q: %v", finalname, err)
+			e := fmt.Errorf("creating folders for final file %q: %w", finalname, err)
 			gf.recordFailure(j, started, noTimeout, e, report)
 			continue
 		}
 		if err := gf.OS.Rename(tmpfile, finalname); err != nil {
-			e := fmt.Errorf("renaming %q to %q: %v", tmpfile, finalname, err)
+			e := fmt.Errorf("renaming %q to %q: %w", tmpfile, finalname, err)
 			gf.recordFailure(j, started, noTimeout, e, report)
 			continue
 		}
 
-		// TODO(jasonco): make the posix attributes match the source
-		// This will only work if the original upload sends the posix
-		// attributes to GCS. For now, we'll just give the user full
-		// access.
-		mode := os.FileMode(0555)
+		// Make the posix attributes match the source, as recorded in the
+		// manifest by the uploader.
+		mode := j.fileMode()
 		if err := gf.OS.Chmod(finalname, mode); err != nil {
 			e := fmt.Errorf("chmod %q to %v: %v", finalname, mode, err)
 			gf.recordFailure(j, started, noTimeout, e, report)
 			continue
 		}
+		if !j.mtime.IsZero() {
+			if err := gf.OS.Chtimes(finalname, j.mtime, j.mtime); err != nil {
+				e := fmt.Errorf("setting modification time of %q to %v: %v", finalname, j.mtime, err)
+				gf.recordFailure(j, started, noTimeout, e, report)
+				continue
+			}
+		}
 
 		gf.recordSuccess(j, started, size, finalname, report)
 		break // Success! No more retries needed.
 	}
+	if !report.success && j.sliceOf == "" && tmpfile != "" {
+		// The last attempt failed, and there is no retry to resume it.
+		gf.OS.RemoveAll(tmpfile)
+	}
 
+	timeoutExhausted(report)
 	return report
 }
 
@@ -320,7 +568,17 @@ func (gf *Fetcher) fetchObject(ctx context.Context, j job) *jobReport {
 // using a circuit breaker pattern to timeout the call if it takes too long.
 // GCS has long tail latencies, so we retry with low timeouts on the first
 // couple of attempts. On subsequent attempts, we simply wait for a long time.
-func (gf *Fetcher) fetchObjectOnceWithTimeout(ctx context.Context, j job, timeout time.Duration, dest string) (sizeBytes, error) {
+// The call is not waited for once it timed out or ctx is done, but its
+// reader is cancelled so that it stops promptly. Resumable downloads wait for
+// the cancelled call instead, so that the next attempt resumes from the bytes
+// it wrote.
+func (gf *Fetcher) fetchObjectOnceWithTimeout(ctx context.Context, j job, timeout time.Duration, dest string) fetchOnceResult {
+	if err := ctx.Err(); err != nil {
+		return fetchOnceResult{err: err}
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	result := make(chan fetchOnceResult, 1)
 	breakerSig := make(chan struct{}, 1)
 
@@ -332,28 +590,55 @@ func (gf *Fetcher) fetchObjectOnceWithTimeout(ctx context.Context, j job, timeou
 	// Wait to see who finshes first: function or timeout
 	select {
 	case r := <-result:
-		return r.size, r.err
-	case <-ctx.Done():
+		return r
+	case <-parent.Done():
 		close(breakerSig) // Signal fetchObjectOnce() to cancel
-		if ctx.Err() == context.DeadlineExceeded {
-			return 0, errGCSTimeout
-		}
-		return 0, ctx.Err()
+		return fetchOnceResult{err: parent.Err()}
 	case <-time.After(timeout):
-		close(breakerSig) // Signal fetchObjectOnce() to cancel
-		return 0, errGCSTimeout
+		if !gf.resumable(j) {
+			close(breakerSig) // Signal fetchObjectOnce() to cancel
+			return fetchOnceResult{err: errGCSTimeout}
+		}
+		cancel() // Cancel the reader, and keep the bytes read so far.
+		r := <-result
+		if r.err == nil {
+			return r
+		}
+		return fetchOnceResult{err: errGCSTimeout, partial: r.partial}
 	}
 }
 
-// fetchObjectOnce has the responsibility of downloading a file from
-// GCS and saving it to the dest location. If it receives a signal on
-// breakerSig, it will attempt to return quickly, though it is assumed
-// that no one is listening for a response anymore.
-func (gf *Fetcher) fetchObjectOnce(ctx context.Context, j job, dest string, breakerSig <-chan struct{}) fetchOnceResult {
-	var result fetchOnceResult
-
-	r, err := gf.GCS.NewReader(ctx, j.bucket, j.object)
+// newReader returns a reader for the object of job j from its backend, or
+// for its slice of the object if j is part of a sliced download, or for the
+// rest of the object if j resumes a failed download. Failures due
+// to missing permissions or a missing object are reported as PermissionError
+// and NotFoundError respectively.
+func (gf *Fetcher) newReader(ctx context.Context, j job) (io.ReadCloser, error) {
+	g, err := gf.backend(j.bucket)
 	if err != nil {
+		return nil, err
+	}
+	var r io.ReadCloser
+	switch {
+	case j.sliceOf != "":
+		r, err = g.(RangeGCS).NewRangeReader(ctx, j.bucket, j.object, j.generation, j.offset, j.length)
+	case j.resumeFrom > 0:
+		r, err = g.(RangeGCS).NewRangeReader(ctx, j.bucket, j.object, j.generation, j.resumeFrom, j.size-j.resumeFrom)
+	default:
+		r, err = g.NewReader(ctx, j.bucket, j.object, j.generation)
+	}
+	if err != nil {
+		if code, ok := httpStatus(err); scheme(j.bucket) != "gs" && (errors.Is(err, os.ErrPermission) || ok && code == http.StatusForbidden) {
+			return nil, &PermissionError{JobInfo: j.info()}
+		}
+		switch {
+		case common.IsUserProjectMissing(err):
+			return nil, &UserProjectError{JobInfo: j.info()}
+		case common.IsEncryptionKeyMissing(err):
+			return nil, &EncryptionKeyError{JobInfo: j.info()}
+		case common.IsEncryptionKeyIncorrect(err):
+			return nil, &EncryptionKeyError{JobInfo: j.info(), Incorrect: true}
+		}
 		// Check for AccessDenied failure here and return a useful error message on Stderr and exit immediately.
 		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusForbidden {
 			// Try to parse out the robot name.
@@ -362,10 +647,27 @@ func (gf *Fetcher) fetchObjectOnce(ctx context.Context, j job, dest string, brea
 			if len(match) == 2 {
 				robot = match[1]
 			}
-			result.err = &permissionError{bucket: j.bucket, robot: robot}
-			return result
+			return nil, &PermissionError{JobInfo: j.info(), Robot: robot}
 		}
-		result.err = fmt.Errorf("creating GCS reader for %q: %v", formatGCSName(j.bucket, j.object, j.generation), err)
+		if isNotFound(err) {
+			return nil, &NotFoundError{JobInfo: j.info()}
+		}
+		return nil, fmt.Errorf("creating reader for %q: %w", formatGCSName(j.bucket, j.object, j.generation), err)
+	}
+	return r, nil
+}
+
+// fetchObjectOnce has the responsibility of downloading a file from
+// GCS and saving it to the dest location. If it receives a signal on
+// breakerSig, it will attempt to return quickly, though it is assumed
+// that no one is listening for a response anymore.
+func (gf *Fetcher) fetchObjectOnce(ctx context.Context, j job, dest string, breakerSig <-chan struct{}) fetchOnceResult {
+	var result fetchOnceResult
+
+	r, err := gf.newReader(ctx, j)
+	if err != nil {
+		result.err = err
+		result.partial = gf.keepPartial(j, dest, breakerSig)
 		return result
 	}
 	defer func() {
@@ -378,26 +680,63 @@ func (gf *Fetcher) fetchObjectOnce(ctx context.Context, j job, dest string, brea
 	select {
 	case <-breakerSig:
 		result.err = errGCSTimeout
+		gf.keepPartial(j, dest, breakerSig)
 		return result
 	default:
 		// Fallthrough
 	}
 
-	f, err := gf.OS.Create(dest)
+	sums := newChecksums(j)
+	var f *os.File
+	var w io.Writer
+	switch {
+	case j.sliceOf != "":
+		// Slices are written in place, at their offset into the file.
+		if f, err = gf.OS.OpenFile(dest, os.O_WRONLY, 0); err == nil {
+			w = io.NewOffsetWriter(f, j.offset)
+		}
+	case j.resumeFrom > 0:
+		f, w, err = gf.openResumed(j, dest, sums)
+	default:
+		f, err = gf.OS.Create(dest)
+		w = f
+	}
 	if err != nil {
-		result.err = fmt.Errorf("creating destination file %q: %v", dest, err)
+		if j.resumeFrom > 0 {
+			gf.OS.RemoveAll(dest)
+		}
+		result.err = fmt.Errorf("creating destination file %q: %w", dest, err)
 		return result
 	}
 	defer func() {
 		if cerr := f.Close(); cerr != nil {
 			result.err = fmt.Errorf("Failed to close file %q: %v", dest, cerr)
+			result.partial = 0
+		}
+		// Do not leave partial temp files behind, unless the download is
+		// resumed from them; not once the attempt timed out though, as no
+		// one waits for its result anymore. Slices share the staged file
+		// being assembled instead.
+		select {
+		case <-breakerSig:
+			result.partial = 0
+		default:
+		}
+		if result.err != nil && j.sliceOf == "" && result.partial == 0 {
+			gf.OS.RemoveAll(dest)
 		}
 	}()
 
-	h := sha1.New()
-	n, err := io.Copy(f, io.TeeReader(r, h))
+	n, err := io.Copy(w, io.TeeReader(gf.limits.reader(ctx, j.transfer.reader(r)), sums))
 	if err != nil {
-		result.err = fmt.Errorf("copying bytes from %q to %q: %v", formatGCSName(j.bucket, j.object, j.generation), dest, err)
+		if gf.resumable(j) && j.resumeFrom+n > 0 {
+			result.partial = j.resumeFrom + n
+		}
+		result.err = fmt.Errorf("copying bytes from %q to %q: %w", formatGCSName(j.bucket, j.object, j.generation), dest, err)
+		return result
+	}
+	if j.sliceOf != "" && n != j.length {
+		result.err = fmt.Errorf("copying bytes from %q to %q: got %d bytes at offset %d, want %d", formatGCSName(j.bucket, j.object, j.generation), dest, n, j.offset, j.length)
 		return result
 	}
 
@@ -410,20 +749,22 @@ func (gf *Fetcher) fetchObjectOnce(ctx context.Context, j job, dest string, brea
 		// Fallthrough
 	}
 
-	result.size = sizeBytes(n)
+	result.size = sizeBytes(j.resumeFrom + n)
 
-	// Verify the sha1sum before declaring success.
-	if j.sha1sum != "" {
-		got := strings.ToLower(fmt.Sprintf("%x", h.Sum(nil)))
-		want := strings.ToLower(nonHexRegex.ReplaceAllString(j.sha1sum, ""))
-		if got != want {
-			result.err = fmt.Errorf("%s SHA mismatch, got %q, want %q", j.filename, got, want)
-			return result
-		}
+	// Verify the checksums before declaring success. Slices are verified
+	// once they are assembled.
+	if j.sliceOf == "" {
+		result.err = sums.verify()
 	}
 	return result
 }
 
+// tempSeq returns a number that is unique for the lifetime of gf, for use in
+// temp file names.
+func (gf *Fetcher) tempSeq() uint32 {
+	return atomic.AddUint32(&gf.seq, 1)
+}
+
 // ensureFolders takes a full path to a filename and makes sure that
 // all the folders leading to the filename exist.
 func (gf *Fetcher) ensureFolders(filename string) error {
@@ -432,198 +773,217 @@ func (gf *Fetcher) ensureFolders(filename string) error {
 	defer gf.mu.Unlock()
 	if _, ok := gf.CreatedDirs[filedir]; !ok {
 		if err := gf.OS.MkdirAll(filedir, os.FileMode(0777)|os.ModeDir); err != nil {
-			return fmt.Errorf("ensuring folders for %q: %v", filedir, err)
+			return fmt.Errorf("ensuring folders for %q: %w", filedir, err)
 		}
 		gf.CreatedDirs[filedir] = true
 	}
 	return nil
 }
 
+// removeStagingDir removes gf.StagingDir, and forgets that it and the folders
+// in it were created, so that a later fetch creates them again.
+func (gf *Fetcher) removeStagingDir() error {
+	gf.mu.Lock()
+	defer gf.mu.Unlock()
+	staging := filepath.Clean(gf.StagingDir)
+	for dir := range gf.CreatedDirs {
+		if dir == staging || strings.HasPrefix(dir, staging+string(filepath.Separator)) {
+			delete(gf.CreatedDirs, dir)
+		}
+	}
+	return gf.OS.RemoveAll(gf.StagingDir)
+}
+
 // doWork is the worker routine. It listens for jobs, fetches the file,
 // and emits a job report. This continues until channel job is closed.
 func (gf *Fetcher) doWork(ctx context.Context, todo <-chan job, results chan<- jobReport) {
 	for j := range todo {
-		report := gf.fetchObject(ctx, j)
-		if gf.Verbose {
-			gf.log("Report: %#v", report)
+		report := gf.fetchLocal(j)
+		if report == nil && j.copyOf != "" {
+			report = gf.copyDuplicate(j)
+		}
+		if report == nil {
+			report = gf.fetchObject(ctx, j)
+			if report.success {
+				gf.addToCache(j, report.finalname)
+			}
+		}
+		if j.sliceOf == "" {
+			gf.progress.done(report)
 		}
 		results <- *report
 	}
 }
 
 // processJobs is the primary concurrency mechanics for Fetcher.
-// This method spins up a set of worker goroutines, creates a
-// goroutine to send all the jobs to the workers, then waits for
-// all the jobs to complete. It also compiles and returns final
-// statistics for the jobs.
+// It sends all the jobs to processJobStream, which fetches them, largest
+// first.
 func (gf *Fetcher) processJobs(ctx context.Context, jobs []job) stats {
-	workerCount := gf.WorkerCount
-	if len(jobs) < workerCount {
-		workerCount = len(jobs)
-	}
-	todo := make(chan job, workerCount)
-	results := make(chan jobReport, workerCount)
-	stats := stats{workers: workerCount, files: len(jobs), success: true}
-
-	// Spin up our workers.
-	var wg sync.WaitGroup
-	for i := 0; i < workerCount; i++ {
-		wg.Add(1)
-		go func() {
-			gf.doWork(ctx, todo, results)
-			wg.Done()
-		}()
-	}
-
-	// Queue the jobs.
-	started := time.Now()
-	var qwg sync.WaitGroup
-	qwg.Add(1)
+	jobs = append([]job(nil), jobs...)
+	sort.SliceStable(jobs, func(a, b int) bool { return jobs[a].size > jobs[b].size })
+	todo := make(chan job)
 	go func() {
 		for _, j := range jobs {
 			todo <- j
 		}
-		qwg.Done()
+		close(todo)
+	}()
+	return gf.processJobStream(ctx, todo)
+}
+
+// processJobStream fetches the jobs received from jobs until it is closed.
+// It spins up a worker goroutine for each of the first gf.WorkerCount jobs,
+// hands all the jobs to the workers as scheduled by schedule, then waits for
+// all the jobs to complete. It also compiles and returns final statistics
+// for the jobs, including the errors of failed jobs.
+func (gf *Fetcher) processJobStream(ctx context.Context, jobs <-chan job) stats {
+	todo := make(chan job)
+	results := make(chan jobReport, gf.WorkerCount)
+	stats := stats{success: true}
+
+	// Queue the jobs, spinning up our workers as they are needed. Once ctx
+	// is done, the remaining jobs are skipped rather than failed one by one.
+	started := time.Now()
+	workerCount, skipped := 0, 0
+	go func() {
+		var wg sync.WaitGroup
+		skipped = schedule(jobs, todo, scheduleWindow*gf.WorkerCount, ctx.Done(), func() {
+			if workerCount < gf.WorkerCount {
+				workerCount++
+				wg.Add(1)
+				go func() {
+					gf.doWork(ctx, todo, results)
+					wg.Done()
+				}()
+			}
+		})
+		close(todo)
+		wg.Wait()
+		close(results)
 	}()
 
 	// Consume the reports.
-	failed := false
-	hasPermissionError := false
-	for n := 0; n < len(jobs); n++ {
-		report := <-results
+	for report := range results {
+		stats.files++
+		stats.busy += report.completed.Sub(report.started)
 		if !report.success {
-			if err, ok := report.err.(*permissionError); ok {
-				hasPermissionError = true
-				gf.logErr(err.Error())
-			}
-			failed = true
+			stats.success = false
 		}
 		stats.size += report.size
+		if report.cached > 0 {
+			stats.cacheHits++
+			stats.cached += report.cached
+		}
+		if report.copied > 0 {
+			stats.duplicates++
+		}
+		stats.logical += report.size + report.cached + report.copied
 		lastIndex := len(report.attempts) - 1
 		stats.retries += lastIndex // First attempt is not considered a "retry".
+		for _, attempt := range report.attempts[:lastIndex] {
+			if attempt.class == throttledError {
+				stats.throttledRetries++
+			} else {
+				stats.transientRetries++
+			}
+		}
 		finalAttempt := report.attempts[lastIndex]
+		if !report.success && finalAttempt.class == permanentError {
+			stats.permanentFailures++
+		}
 		stats.duration += finalAttempt.duration
-		if finalAttempt.err != nil {
-			stats.errs = append(stats.errs, finalAttempt.err)
+		if report.err != nil {
+			stats.errs = append(stats.errs, report.err)
 		}
 		for _, attempt := range report.attempts {
 			if attempt.gcsTimeout > noTimeout {
 				stats.gcsTimeouts++
 			}
 		}
+		stats.slowestReports.add(report)
+		if gf.ReportWriter != nil {
+			stats.reports = append(stats.reports, report)
+		}
 	}
-	qwg.Wait()
-	close(results)
-	close(todo)
-	wg.Wait()
 
-	if failed {
+	// The queue has closed results, after its last write to workerCount.
+	stats.workers = workerCount
+	if skipped > 0 {
 		stats.success = false
-		gf.logErr("Failed to download at least one file. Cannot continue.")
-		if hasPermissionError {
-			os.Exit(permissionDeniedExitStatus)
-		}
-		os.Exit(errorExitStatus)
+		stats.errs = append(stats.errs, fmt.Errorf("skipped %d files: %w", skipped, ctx.Err()))
 	}
-
 	stats.duration = time.Since(started)
 	return stats
 }
 
-// getTimeout returns the GCS timeout that should be used for a given
-// filenum on a given retry number. GCS has long tails on occasion, so
-// in some cases, it's faster to give up early and retry on a second
-// connection.
-func (gf *Fetcher) timeout(filename string, retrynum int) time.Duration {
-	if gf.TimeoutGCS == false {
-		return defaultTimeout
-	}
-
-	// Use short timeouts for source code, longer for non-source
-	if sourceExt[filepath.Ext(filename)] {
-		if timeout, ok := sourceTimeout[retrynum]; ok {
-			return timeout
-		}
-	} else {
-		if timeout, ok := notSourceTimeout[retrynum]; ok {
-			return timeout
-		}
-	}
-	return defaultTimeout
-}
-
 // fetchFromManifest is used when downloading source based on a manifest file.
 // It is responsible for fetching the manifest file, decoding the JSON, and
 // assembling the list of jobs to process (i.e., files to download).
 func (gf *Fetcher) fetchFromManifest(ctx context.Context) (err error) {
 	started := time.Now()
-	gf.log("Fetching manifest %s.", formatGCSName(gf.Bucket, gf.Object, gf.Generation))
-
-	// Download the manifest file from GCS.
-	manifestDir := gf.StagingDir
-	j := job{
-		filename:        gf.Object,
-		bucket:          gf.Bucket,
-		object:          gf.Object,
-		generation:      gf.Generation,
-		destDirOverride: manifestDir,
-	}
-	// Override the retry/backoff to span an up-to-11 second eventual consistency
-	// issue on new project creation. We'll only do this for the first file
-	// (the manifest), and then drop back to the original retry/backoff.
-	oretries, obackoff := gf.Retries, gf.Backoff
-	gf.Retries, gf.Backoff = 6, 1*time.Second // Yields 1s, 2s, 4s, 8s, 16s
-	report := gf.fetchObject(ctx, j)
-	gf.Retries, gf.Backoff = oretries, obackoff
-	if !report.success {
-		if err, ok := report.err.(*permissionError); ok {
-			gf.logErr(err.Error())
-			os.Exit(permissionDeniedExitStatus)
-		}
-		return fmt.Errorf("failed to download manifest %s: %v", formatGCSName(gf.Bucket, gf.Object, gf.Generation), report.err)
+	rep := gf.newReport(started)
+	if gf.filter, err = newPathFilter(gf.Include, gf.Exclude); err != nil {
+		return err
 	}
-
-	// Decode the JSON manifest
-	manifestFile := filepath.Join(manifestDir, j.filename)
-	r, err := gf.OS.Open(manifestFile)
+	report, err := gf.fetchManifest(ctx)
 	if err != nil {
-		return fmt.Errorf("opening manifest file %q: %v", manifestFile, err)
-	}
-	defer func() {
-		if cerr := r.Close(); cerr != nil {
-			err = fmt.Errorf("Failed to close file %q: %v", manifestFile, cerr)
-		}
-	}()
-	var files map[string]common.ManifestItem
-	if err := json.NewDecoder(r).Decode(&files); err != nil {
-		return fmt.Errorf("decoding JSON from manifest file %q: %v", manifestFile, err)
+		return err
 	}
 
-	// Create the jobs
-	var jobs []job
-	for filename, info := range files {
-		bucket, object, generation, err := common.ParseBucketObject(info.SourceURL)
-		if err != nil {
-			return fmt.Errorf("parsing bucket/object from %q: %v", info.SourceURL, err)
-		}
-		j := job{
-			filename:   filename,
-			bucket:     bucket,
-			object:     object,
-			generation: generation,
-			sha1sum:    info.Sha1Sum,
+	// Fetch the files as the manifest is decoded. Every distinct file is
+	// fetched only once, and copied to the paths of its duplicates afterwards.
+	todo := make(chan job)
+	var (
+		duplicates []job
+		filtered   int
+		readErr    error
+	)
+	stopProgress := gf.startProgress(rep, true)
+	defer stopProgress()
+	go func() {
+		d := deduper{}
+		filtered, readErr = gf.readManifest(func(j job) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			gf.progress.queue(j)
+			if j, dup := d.add(j); dup {
+				duplicates = append(duplicates, j)
+				return nil
+			}
+			todo <- j
+			return nil
+		})
+		gf.progress.listed()
+		close(todo)
+	}()
+	stats := gf.processJobStream(ctx, todo)
+	if readErr != nil {
+		rep.reportFiles(stats)
+		if err := gf.removeStagingDir(); err != nil {
+			gf.log("Failed to remove staging dir %v, continuing: %v", gf.StagingDir, err)
 		}
-		jobs = append(jobs, j)
+		return readErr
+	}
+	if gf.filter != nil {
+		gf.log("Processed %v files, %v were filtered out.", stats.files+len(duplicates), filtered)
+	}
+	if stats.success && len(duplicates) > 0 {
+		stats.add(gf.processJobs(ctx, duplicates))
+	}
+	stopProgress()
+	rep.reportFiles(stats)
+	rep.reportLimits(gf.limits)
+	rep.Totals.FilteredFiles = filtered
+	if !stats.success {
+		gf.logErr("Failed to download at least one file. Cannot continue.")
 	}
-
-	gf.log("Processing %v files.", len(jobs))
-	stats := gf.processJobs(ctx, jobs)
 
 	// Final cleanup of failed downloads. We won't miss any files; these vestiges
 	// are from go routines that have timed out and would otherwise check their
 	// circuit breaker and die. However, we won't wait for these remaining
 	// go routines to finish because out goal is to get done as fast as possible!
-	if err := gf.OS.RemoveAll(gf.StagingDir); err != nil {
+	if err := gf.removeStagingDir(); err != nil {
 		gf.log("Failed to remove staging dir %v, continuing: %v", gf.StagingDir, err)
 	}
 
@@ -644,25 +1004,44 @@ func (gf *Fetcher) fetchFromManifest(ctx context.Context) (err error) {
 	gf.log("Completed:                   %s", time.Now().Format(time.RFC3339))
 	gf.log("Requested workers: %6d", gf.WorkerCount)
 	gf.log("Actual workers:    %6d", stats.workers)
+	gf.log("Worker utilization:%6.1f%%", 100*stats.utilization())
 	gf.log("Total files:       %6d", stats.files)
 	gf.log("Total retries:     %6d", stats.retries)
+	gf.log("  transient:       %6d", stats.transientRetries)
+	gf.log("  throttled:       %6d", stats.throttledRetries)
+	gf.log("Permanent errors:  %6d", stats.permanentFailures)
 	if gf.TimeoutGCS {
 		gf.log("GCS timeouts:      %6d", stats.gcsTimeouts)
 	}
+	if stats.cacheHits > 0 || gf.CacheDir != "" {
+		var ratio float64
+		if stats.files > 0 {
+			ratio = 100 * float64(stats.cacheHits) / float64(stats.files)
+		}
+		gf.log("Cache hits:        %6d (%.1f%%)", stats.cacheHits, ratio)
+		gf.log("MiB saved:         %9.2f MiB", float64(stats.cached)/1024/1024)
+	}
+	if gf.filter != nil {
+		gf.log("Filtered files:    %6d", filtered)
+	}
+	gf.log("Duplicate files:   %6d", stats.duplicates)
+	gf.log("Logical MiB:       %9.2f MiB", float64(stats.logical)/1024/1024)
 	gf.log("MiB downloaded:    %9.2f MiB", mib)
 	gf.log("MiB/s throughput:  %9.2f MiB/s", mibps)
+	gf.logLimits()
+	if slowest := stats.slowest(slowestFiles); len(slowest) > 0 {
+		gf.log("Slowest files:")
+		for _, report := range slowest {
+			gf.log("  %9.2f s  %s (%.2f MiB)", report.completed.Sub(report.started).Seconds(), report.job.filename, float64(report.size+report.cached+report.copied)/1024/1024)
+		}
+	}
 
 	gf.log("Time for manifest: %9.2f ms", float64(manifestDuration)/float64(time.Millisecond))
 	gf.log("Total time:        %9.2f s", time.Since(started).Seconds())
 	gf.log("******************************************************")
 
 	if len(stats.errs) > 0 {
-		var es []string
-		es = append(es, fmt.Sprintf("Errors (%d):", len(stats.errs)))
-		for _, e := range stats.errs {
-			es = append(es, fmt.Sprintf(" - %s", e))
-		}
-		return errors.New(strings.Join(es, "\n"))
+		return &FetchError{Errs: stats.errs}
 	}
 	return nil
 }
@@ -695,253 +1074,222 @@ func (gf *Fetcher) copyFile(name string, mode os.FileMode, rc io.ReadCloser) (er
 	return nil
 }
 
-// fetchFromZip is used when downloading a single zip of source files. It is
-// responsible to fetch the zip file and unzip it into the destination folder.
-func (gf *Fetcher) fetchFromZip(ctx context.Context) (err error) {
+// fetchFromArchive is used when downloading a single archive of source
+// files. It is responsible to fetch the archive and extract it into the
+// destination folder. sourceType is the format of the archive, or "Auto" to
+// detect the format from the downloaded archive.
+//
+// Archives of at least gf.SliceThreshold bytes are downloaded in slices.
+// Otherwise, if gf.Stream is set, tar-based archives are extracted while they
+// are being downloaded instead of being staged on disk first.
+// archiveTimeLabels are the summary labels of the download and extraction
+// times of the archive types that were supported first, which build logs
+// may be scraped for. Other types get generic labels.
+var archiveTimeLabels = map[string][2]string{
+	"ZipArchive":   {"Time for zipfile:", "Time to unzip:"},
+	"TarGzArchive": {"Time for tgzfile:", "Time to untgz:"},
+}
+
+func (gf *Fetcher) fetchFromArchive(ctx context.Context, sourceType string) (err error) {
 	started := time.Now()
+	rep := gf.newReport(started)
+	if gf.filter, err = newPathFilter(gf.Include, gf.Exclude); err != nil {
+		return err
+	}
 	gf.log("Fetching archive %s.", formatGCSName(gf.Bucket, gf.Object, gf.Generation))
 
-	// Download the archive from GCS.
-	zipDir := gf.StagingDir
+	archiveDir := gf.StagingDir
 	j := job{
 		filename:        gf.Object,
 		bucket:          gf.Bucket,
 		object:          gf.Object,
 		generation:      gf.Generation,
-		destDirOverride: zipDir,
+		destDirOverride: archiveDir,
 	}
-	report := gf.fetchObject(ctx, j)
-	if !report.success {
-		if err, ok := report.err.(*permissionError); ok {
-			gf.logErr(err.Error())
-			os.Exit(permissionDeniedExitStatus)
+
+	var report *jobReport
+	var x *extractor
+	stopProgress := gf.startProgress(rep, false)
+	defer stopProgress()
+	attrs := gf.objectAttrs(ctx, j)
+	if attrs != nil {
+		j.size = attrs.Size
+		j.attrs = attrs
+		if j.generation == 0 {
+			// Read the generation whose checksums are verified.
+			j.generation = attrs.Generation
 		}
-		return fmt.Errorf("failed to download archive %s: %v", formatGCSName(gf.Bucket, gf.Object, gf.Generation), report.err)
 	}
-
-	// Unzip into the destination directory
-	zipfile := filepath.Join(zipDir, gf.Object)
-	unzipStart := time.Now()
-	numFiles, err := unzip(zipfile, gf.DestDir)
-	if err != nil {
-		return err
+	// Neither sliced nor streamed downloads check this themselves, and other
+	// backends than GCS may have attributes without checksums.
+	if gf.RequireChecksums && !verifiable(j) {
+		return &UnverifiableError{JobInfo: j.info()}
 	}
-	unzipDuration := time.Since(unzipStart)
-
-	if !gf.KeepSource {
-		// Remove the zip file (best effort only, no harm if this fails).
-		if err := os.RemoveAll(zipfile); err != nil {
-			gf.log("Failed to remove zipfile %s, continuing: %v", zipfile, err)
-		}
-
-		// Final cleanup of staging directory, which is only a temporary staging
-		// location for downloading the zipfile in this case.
-		if err := gf.OS.RemoveAll(gf.StagingDir); err != nil {
-			gf.log("Failed to remove staging dir %q, continuing: %v", gf.StagingDir, err)
+	gf.progress.queue(j)
+	if gf.sliced(j, attrs) {
+		// Large archives download faster in slices than in a single stream.
+		report = gf.fetchSliced(ctx, j, attrs)
+	} else if gf.Stream && !gf.KeepSource && sourceType != "ZipArchive" {
+		report, x, sourceType = gf.streamArchive(ctx, j, sourceType)
+		if report == nil {
+			gf.log("Archive is a zip archive, which cannot be streamed; downloading it first.")
 		}
 	}
 
-	mib := float64(report.size) / 1024 / 1024
-	var mibps float64
-	zipfileDuration := report.attempts[len(report.attempts)-1].duration
-	if zipfileDuration > 0 {
-		mibps = mib / zipfileDuration.Seconds()
+	var extractDuration time.Duration
+	if report == nil {
+		// Download the archive from GCS.
+		report = gf.fetchObject(ctx, j)
 	}
-	gf.log("******************************************************")
-	gf.log("Status:                      SUCCESS")
-	gf.log("Started:                     %s", started.Format(time.RFC3339))
-	gf.log("Completed:                   %s", time.Now().Format(time.RFC3339))
-	gf.log("Total files:       %6d", numFiles)
-	gf.log("MiB downloaded:    %9.2f MiB", mib)
-	gf.log("MiB/s throughput:  %9.2f MiB/s", mibps)
-	gf.log("Time for zipfile:  %9.2f s", zipfileDuration.Seconds())
-	gf.log("Time to unzip:     %9.2f s", unzipDuration.Seconds())
-	gf.log("Total time:        %9.2f s", time.Since(started).Seconds())
-	gf.log("******************************************************")
-	return nil
-}
-
-func unzip(zipfile, dest string) (numFiles int, err error) {
-	zipReader, err := zip.OpenReader(zipfile)
-	if err != nil {
-		return 0, fmt.Errorf("opening archive %s: %v", zipfile, err)
+	gf.progress.done(report)
+	stopProgress()
+	rep.Source = newFileReport(report)
+	if !report.success {
+		return fmt.Errorf("failed to download archive %s: %w", formatGCSName(gf.Bucket, gf.Object, gf.Generation), report.err)
 	}
-	defer func() {
-		if cerr := zipReader.Close(); cerr != nil {
-			err = fmt.Errorf("closing archive %s: %v", zipfile, cerr)
-		}
-	}()
 
-	numFiles = 0
-	for _, file := range zipReader.File {
-		target := filepath.Join(dest, file.Name)
-
-		if file.FileInfo().IsDir() {
-			// Create directory with appropriate permissions if it doesn't exist.
-			if _, err := os.Stat(target); os.IsNotExist(err) {
-				if err := os.MkdirAll(target, file.Mode()); err != nil {
-					return 0, fmt.Errorf("making directory %s: %v", target, err)
-				}
-				continue
-			} else if err != nil {
-				return 0, fmt.Errorf("checking existence on %s: %v", target, err)
-			}
-			// If directory already exists, it may have been created below as a
-			// parent directory when processing a file. In this case, we must
-			// set the directory's permissions correctly.
-			if err := os.Chmod(target, file.Mode()); err != nil {
-				return 0, fmt.Errorf("setting permissions on %s: %v", target, err)
+	streamed := x != nil
+	if !streamed {
+		archive := filepath.Join(archiveDir, gf.Object)
+		if sourceType == "Auto" {
+			if sourceType, err = detectArchiveType(archive); err != nil {
+				return err
 			}
-			continue
+			gf.log("Detected archive type %s.", sourceType)
 		}
 
-		// Create parent directories with full access. This only matters if the
-		// file comes from zipReader before the directory. In this case, the
-		// file permissions will be set to the correct value when the directory
-		// itself is processed above.
-		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
-			return 0, fmt.Errorf("making parent directories for %s: %v", target, err)
+		// Extract into the destination directory
+		extractStart := time.Now()
+		x = gf.newExtractor(int64(report.size))
+		if sourceType == "ZipArchive" {
+			err = unzip(archive, x)
+		} else {
+			err = untarFile(archive, tarDecompressors[sourceType], x)
 		}
-
-		// Actually copy the bytes, using func to get early defer calls
-		// (important for large numbers of files).
-		numFiles++
-		reader, err := file.Open()
 		if err != nil {
-			return 0, fmt.Errorf("opening file in %s: %v", target, err)
-		}
-		if err := func() (ferr error) {
-			writer, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE, file.Mode())
-			if err != nil {
-				return fmt.Errorf("opening target file %s: %v", target, err)
-			}
-			defer func() {
-				if cerr := writer.Close(); cerr != nil {
-					ferr = fmt.Errorf("closing target file %s: %v", target, cerr)
-				}
-			}()
-			if _, err := io.Copy(writer, reader); err != nil {
-				return fmt.Errorf("copying %s to %s: %v", file.Name, target, err)
-			}
-			return nil
-		}(); err != nil {
-			return 0, err
+			return err
 		}
-	}
-	return numFiles, nil
-}
+		extractDuration = time.Since(extractStart)
 
-// fetchFromTarGz is used when downloading a single .tar.gz of source files. It
-// is responsible to fetch the .tar.gz file and unzip it into the destination
-// folder.
-func (gf *Fetcher) fetchFromTarGz(ctx context.Context) (err error) {
-	started := time.Now()
-	gf.log("Fetching archive %s.", formatGCSName(gf.Bucket, gf.Object, gf.Generation))
+		if !gf.KeepSource {
+			// Remove the archive (best effort only, no harm if this fails).
+			if err := gf.OS.RemoveAll(archive); err != nil {
+				gf.log("Failed to remove archive %s, continuing: %v", archive, err)
+			}
 
-	// Download the archive from GCS.
-	tgzDir := gf.StagingDir
-	j := job{
-		filename:        gf.Object,
-		bucket:          gf.Bucket,
-		object:          gf.Object,
-		generation:      gf.Generation,
-		destDirOverride: tgzDir,
-	}
-	report := gf.fetchObject(ctx, j)
-	if !report.success {
-		if err, ok := report.err.(*permissionError); ok {
-			gf.logErr(err.Error())
-			os.Exit(permissionDeniedExitStatus)
+			// Final cleanup of staging directory, which is only a temporary staging
+			// location for downloading the archive in this case.
+			if err := gf.removeStagingDir(); err != nil {
+				gf.log("Failed to remove staging dir %q, continuing: %v", gf.StagingDir, err)
+			}
 		}
-		return fmt.Errorf("failed to download archive %s: %v", formatGCSName(gf.Bucket, gf.Object, gf.Generation), report.err)
 	}
 
-	// Untgz into the destination directory
-	untgzStart := time.Now()
-	tgzfile := filepath.Join(tgzDir, gf.Object)
-	f, err := os.Open(tgzfile)
-	if err != nil {
-		return err
+	mib := float64(report.size) / 1024 / 1024
+	var mibps float64
+	archiveDuration := report.attempts[len(report.attempts)-1].duration
+	if archiveDuration > 0 {
+		mibps = mib / archiveDuration.Seconds()
 	}
-	gzr, err := gzip.NewReader(f)
-	if err != nil {
-		return err
+	rep.Type = sourceType
+	rep.Totals = ReportTotals{
+		Workers:         1,
+		Files:           1,
+		Retries:         len(report.attempts) - 1,
+		DownloadedBytes: int64(report.size),
+		LogicalBytes:    int64(report.size),
+		MiBPerSecond:    mibps,
+		ExtractedFiles:  x.numFiles,
+		FilteredFiles:   x.filtered,
+		ExtractSeconds:  extractDuration.Seconds(),
 	}
-	tr := tar.NewReader(gzr)
-
-	defer func() {
-		if cerr := f.Close(); cerr != nil {
-			err = fmt.Errorf("Failed to close file %q: %v", tgzfile, cerr)
+	rep.reportLimits(gf.limits)
+	for i, attempt := range report.attempts {
+		if attempt.gcsTimeout > noTimeout {
+			rep.Totals.GCSTimeouts++
 		}
-	}()
-
-	numFiles := 0
-	for {
-		h, err := tr.Next()
-		if err == io.EOF {
+		if i == len(report.attempts)-1 {
 			break
 		}
-		if err != nil {
-			return err
-		}
-		n := filepath.Join(gf.DestDir, h.Name)
-		switch h.Typeflag {
-		case tar.TypeDir:
-			if err := gf.OS.MkdirAll(n, h.FileInfo().Mode()); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			if err := func() error {
-				f, err := os.OpenFile(n, os.O_WRONLY|os.O_CREATE, h.FileInfo().Mode())
-				if err != nil {
-					return err
-				}
-				defer f.Close()
-				_, err = io.Copy(f, tr)
-				return err
-			}(); err != nil {
-				return err
-			}
+		if attempt.class == throttledError {
+			rep.Totals.ThrottledRetries++
+		} else {
+			rep.Totals.TransientRetries++
 		}
 	}
-	untgzDuration := time.Since(untgzStart)
-
-	if !gf.KeepSource {
-		// Remove the tgz file (best effort only, no harm if this fails).
-		if err := gf.OS.RemoveAll(tgzfile); err != nil {
-			gf.log("Failed to remove tgzfile %s, continuing: %v", tgzfile, err)
-		}
 
-		// Final cleanup of staging directory, which is only a temporary staging
-		// location for downloading the tgzfile in this case.
-		if err := gf.OS.RemoveAll(gf.StagingDir); err != nil {
-			gf.log("Failed to remove staging dir %q, continuing: %v", gf.StagingDir, err)
-		}
-	}
-
-	mib := float64(report.size) / 1024 / 1024
-	var mibps float64
-	tgzfileDuration := report.attempts[len(report.attempts)-1].duration
-	if tgzfileDuration > 0 {
-		mibps = mib / tgzfileDuration.Seconds()
-	}
 	gf.log("******************************************************")
 	gf.log("Status:                      SUCCESS")
 	gf.log("Started:                     %s", started.Format(time.RFC3339))
 	gf.log("Completed:                   %s", time.Now().Format(time.RFC3339))
-	gf.log("Total files:       %6d", numFiles)
+	gf.log("Archive type:      %s", sourceType)
+	gf.log("Total files:       %6d", x.numFiles)
+	if gf.filter != nil {
+		gf.log("Filtered entries:  %6d", x.filtered)
+	}
 	gf.log("MiB downloaded:    %9.2f MiB", mib)
 	gf.log("MiB/s throughput:  %9.2f MiB/s", mibps)
-	gf.log("Time for tgzfile:  %9.2f s", tgzfileDuration.Seconds())
-	gf.log("Time to untgz:     %9.2f s", untgzDuration.Seconds())
+	gf.logLimits()
+	if streamed {
+		gf.log("Time to stream:    %9.2f s", archiveDuration.Seconds())
+	} else {
+		labels, ok := archiveTimeLabels[sourceType]
+		if !ok {
+			labels = [2]string{"Time for archive:", "Time to extract:"}
+		}
+		gf.log("%-19s%9.2f s", labels[0], archiveDuration.Seconds())
+		gf.log("%-19s%9.2f s", labels[1], extractDuration.Seconds())
+	}
 	gf.log("Total time:        %9.2f s", time.Since(started).Seconds())
 	gf.log("******************************************************")
 	return nil
 }
 
 // Fetch is the main entry point into Fetcher. Based on configuration,
-// it pulls source from GCS into the destination directory.
+// it pulls source from GCS into the destination directory. If
+// gf.ReportWriter is set, a Report of the fetch is written to it.
 func (gf *Fetcher) Fetch(ctx context.Context) error {
+	gf.report = nil
+	err := gf.fetch(ctx)
+	if err != nil && ctx.Err() != nil {
+		// Abandoned downloads have been cancelled, and remove their temp files;
+		// whatever else was staged is incomplete.
+		gf.logErr("Fetch interrupted: %v", ctx.Err())
+		if rerr := gf.removeStagingDir(); rerr != nil {
+			gf.logErr("Failed to remove staging dir %v: %v", gf.StagingDir, rerr)
+		}
+		err = &InterruptedError{Cause: ctx.Err(), Err: err}
+	}
+	if gf.ReportWriter != nil {
+		if gf.report == nil {
+			// The fetch failed before it started.
+			gf.newReport(time.Now())
+		}
+		if werr := gf.writeReport(gf.ReportWriter, err); werr != nil {
+			gf.logErr("Failed to write report: %v", werr)
+		}
+	}
+	return err
+}
+
+func (gf *Fetcher) fetch(ctx context.Context) error {
+	gf.limits = newLimits(gf.MaxBytesPerSecond, gf.MaxPerBucket)
+	switch gf.UnsupportedEntries {
+	case "", UnsupportedEntriesError, UnsupportedEntriesWarn, UnsupportedEntriesSkip:
+	default:
+		return fmt.Errorf("misconfigured GCSFetcher, unsupported entries policy %q", gf.UnsupportedEntries)
+	}
+	if _, err := gf.backend(gf.Bucket); err != nil {
+		return fmt.Errorf("misconfigured GCSFetcher, cannot fetch %s: %v", formatGCSName(gf.Bucket, gf.Object, gf.Generation), err)
+	}
+
+	if gf.Verify {
+		if gf.SourceType != "Manifest" {
+			return fmt.Errorf("misconfigured GCSFetcher, -verify is only supported with -type=Manifest, not %q", gf.SourceType)
+		}
+		return gf.verifyManifest(ctx)
+	}
+
 	switch gf.SourceType {
 	case "Manifest":
 		return gf.fetchFromManifest(ctx)
@@ -949,20 +1297,26 @@ func (gf *Fetcher) Fetch(ctx context.Context) error {
 		fmt.Println("WARNING: -type=Archive is deprecated; use -type=ZipArchive")
 		fallthrough
 	case "ZipArchive":
-		return gf.fetchFromZip(ctx)
-	case "TarGzArchive":
-		return gf.fetchFromTarGz(ctx)
+		return gf.fetchFromArchive(ctx, "ZipArchive")
+	case "Auto":
+		return gf.fetchFromArchive(ctx, "Auto")
 	default:
+		if _, ok := tarDecompressors[gf.SourceType]; ok {
+			return gf.fetchFromArchive(ctx, gf.SourceType)
+		}
 		return fmt.Errorf("misconfigured GCSFetcher, unsupported -type %q", gf.SourceType)
 	}
-	return nil
 }
 
+// formatGCSName returns the URL of the object, the inverse of
+// common.ParseSourceURL.
 func formatGCSName(bucket, object string, generation int64) string {
+	if scheme(bucket) != "gs" {
+		return bucket + "/" + object
+	}
 	n := fmt.Sprintf("gs://%s/%s", bucket, object)
 	if generation > 0 {
 		n += fmt.Sprintf("#%d", generation)
 	}
 	return n
 }
-
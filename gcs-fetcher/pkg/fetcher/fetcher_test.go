@@ -24,7 +24,6 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"reflect"
 	"sort"
@@ -32,6 +31,7 @@ import (
 	"testing"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"google.golang.org/api/googleapi"
 )
 
@@ -43,6 +43,7 @@ const (
 	sfile2            = "sfile2.jpg"
 	sfile3            = "sfile3"
 	goodManifest      = "good-manifest.json"
+	modeManifest      = "mode-manifest.json"
 	malformedManifest = "malformed-manifest.json"
 
 	errorBucket   = "error-bucket"
@@ -69,6 +70,11 @@ var (
 		"sfile2.jpg": {"SourceURL": "gs://success-bucket/sfile2.jpg", "Sha1Sum": ""},
 		"sfile3":     {"SourceURL": "gs://success-bucket/sfile3", "Sha1Sum": ""}
 	}`)
+	modeManifestContents = []byte(`{
+		"writable.js":   {"sourceUrl": "gs://success-bucket/sfile1.js", "mode": 420, "mtime": "2019-03-04T05:06:07Z"},
+		"bin/tool":      {"sourceUrl": "gs://success-bucket/sfile2.jpg", "mode": 493},
+		"legacy/sfile3": {"sourceUrl": "gs://success-bucket/sfile3"}
+	}`)
 	malformedManifestContents = []byte(`{
 		"sfile1.js": {"SourceURL": "gs://success-bucket/sfile1.js", "Sha1Sum": ""},
 		"sfile2.jpg": {"SourceURL": "gs://succ`)
@@ -105,7 +111,9 @@ type fakeGCS struct {
 	objects map[string]fakeGCSResponse
 }
 
-func (f *fakeGCS) NewReader(context context.Context, bucket, object string) (io.ReadCloser, error) {
+// All instrumented objects live at generation; reading any other pinned
+// generation fails as it would for an overwritten object.
+func (f *fakeGCS) NewReader(context context.Context, bucket, object string, gen int64) (io.ReadCloser, error) {
 	f.t.Helper()
 	name := formatGCSName(bucket, object, generation)
 
@@ -115,6 +123,10 @@ func (f *fakeGCS) NewReader(context context.Context, bucket, object string) (io.
 		return nil, nil
 	}
 
+	if gen != 0 && gen != generation {
+		return nil, storage.ErrObjectNotExist
+	}
+
 	if response.err == errGCSNewReader {
 		return ioutil.NopCloser(bytes.NewReader([]byte(""))), response.err
 	}
@@ -194,10 +206,18 @@ func (f *fakeOS) Open(name string) (*os.File, error) {
 	return os.Open(name)
 }
 
+func (*fakeOS) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
 func (*fakeOS) RemoveAll(path string) error {
 	return os.RemoveAll(path)
 }
 
+func (*fakeOS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
 type testContext struct {
 	gf      *Fetcher
 	gcs     *fakeGCS
@@ -227,6 +247,7 @@ func buildTestContext(t *testing.T) (tc *testContext, teardown func()) {
 			formatGCSName(errorBucket, efile3, generation):              {err: errGCSSlowRead},
 			formatGCSName(errorBucket, efile4, generation):              {err: errGCS403},
 			formatGCSName(successBucket, goodManifest, generation):      {content: goodManifestContents},
+			formatGCSName(successBucket, modeManifest, generation):      {content: modeManifestContents},
 			formatGCSName(successBucket, malformedManifest, generation): {content: malformedManifestContents},
 			formatGCSName(errorBucket, errorManifest, generation):       {err: errGCSRead},
 		},
@@ -293,13 +314,40 @@ func TestGCSAccessDenied(t *testing.T) {
 	if result.err == nil {
 		t.Fatalf("fetchObjectOnce did not fail, got err=nil, want err!=nil")
 	}
-	if err, ok := result.err.(*permissionError); ok {
+	if err, ok := result.err.(*PermissionError); ok {
 		want := `Access to bucket error-bucket denied. You must grant Storage Object Viewer permission to some@robot. If you are using VPC Service Controls, you must also grant it access to your service perimeter.`
 		if err.Error() != want {
 			t.Fatalf("incorrect error message, got %q, want %q", err.Error(), want)
 		}
+		if err.Bucket != errorBucket || err.Object != efile4 || err.Robot != "some@robot" {
+			t.Errorf("PermissionError got %+v, want bucket %q, object %q and robot %q", err, errorBucket, efile4, "some@robot")
+		}
 	} else {
-		t.Fatalf("got err=%q, want permissionError", result.err)
+		t.Fatalf("got err=%q, want PermissionError", result.err)
+	}
+}
+
+func TestFetchObjectOnceHonorsGeneration(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	// The pinned generation exists.
+	j := job{bucket: successBucket, object: sfile1, generation: generation}
+	dest := filepath.Join(tc.workDir, "sfile1.tmp")
+	if result := tc.gf.fetchObjectOnce(context.Background(), j, dest, make(chan struct{}, 1)); result.err != nil {
+		t.Errorf("fetchObjectOnce() result.err got %v, want nil", result.err)
+	}
+
+	// The pinned generation has been overwritten.
+	j = job{bucket: successBucket, object: sfile1, generation: generation - 1}
+	result := tc.gf.fetchObjectOnce(context.Background(), j, dest, make(chan struct{}, 1))
+	nerr, ok := result.err.(*NotFoundError)
+	if !ok {
+		t.Fatalf("fetchObjectOnce() result.err got %v, want NotFoundError", result.err)
+	}
+	want := fmt.Sprintf("generation %d of gs://%s/%s no longer exists", generation-1, successBucket, sfile1)
+	if !strings.HasPrefix(nerr.Error(), want) {
+		t.Errorf("fetchObjectOnce() error got %q, want prefix %q", nerr.Error(), want)
 	}
 }
 
@@ -356,7 +404,8 @@ func TestFetchObjectOnceWithTimeoutSucceeds(t *testing.T) {
 	timeout := 10 * time.Second
 	dest := filepath.Join(tc.workDir, "sfile1.tmp")
 
-	n, err := tc.gf.fetchObjectOnceWithTimeout(context.Background(), j, timeout, dest)
+	result := tc.gf.fetchObjectOnceWithTimeout(context.Background(), j, timeout, dest)
+	n, err := result.size, result.err
 	if err != nil || int(n) != len(sfile1Contents) {
 		t.Errorf("fetchObjectOnceWithTimeout() got (%v, %v), want (%v, %v)", n, err, nil, len(sfile1Contents))
 	}
@@ -370,7 +419,7 @@ func TestFetchObjectOnceWithTimeoutFailsOnTimeout(t *testing.T) {
 	timeout := 100 * time.Millisecond
 	dest := filepath.Join(tc.workDir, "efile3.tmp")
 
-	if _, err := tc.gf.fetchObjectOnceWithTimeout(context.Background(), j, timeout, dest); err == nil {
+	if err := tc.gf.fetchObjectOnceWithTimeout(context.Background(), j, timeout, dest).err; err == nil {
 		t.Errorf("fetchObjectOnceWithTimeout() got err=nil, want err=%v", errGCSTimeout)
 	}
 }
@@ -708,83 +757,88 @@ func TestProcessJobs(t *testing.T) {
 }
 
 func TestFetchFromManifestPermissionDenied(t *testing.T) {
-	if os.Getenv("subprocess") == "1" {
-		tc, teardown := buildTestContext(t)
-		defer teardown()
+	tc, teardown := buildTestContext(t)
+	defer teardown()
 
-		tc.gf.Bucket = errorBucket
-		tc.gf.Object = efile4
+	tc.gf.Bucket = errorBucket
+	tc.gf.Object = efile4
 
-		tc.gf.fetchFromManifest(context.Background())
-		return
-	}
-	cmd := exec.Command(os.Args[0], "-test.run=^TestFetchFromManifestPermissionDenied$")
-	cmd.Env = append(os.Environ(), "subprocess=1")
-	err := cmd.Run()
-	if err == nil {
-		t.Fatal("fetchFromManifest() unexpectedly exited with success")
-	}
-	exitError, ok := err.(*exec.ExitError)
-	if !ok {
-		t.Fatal("fetchFromManifest() unexpectedly exited with unknown error")
+	err := tc.gf.fetchFromManifest(context.Background())
+	var perr *PermissionError
+	if !errors.As(err, &perr) {
+		t.Fatalf("fetchFromManifest() got %v, want PermissionError", err)
 	}
-	exitCode := exitError.ExitCode()
-	if exitCode != permissionDeniedExitStatus {
-		t.Fatalf("fetchFromManifest() exited with wrong status, got %v, want %v", exitCode, permissionDeniedExitStatus)
+	if perr.Bucket != errorBucket || perr.Object != efile4 {
+		t.Errorf("fetchFromManifest() got PermissionError for %s, want %s", formatGCSName(perr.Bucket, perr.Object, 0), formatGCSName(errorBucket, efile4, 0))
 	}
 }
 
 func TestFetchFromZipPermissionDenied(t *testing.T) {
-	if os.Getenv("subprocess") == "1" {
-		tc, teardown := buildTestContext(t)
-		defer teardown()
+	tc, teardown := buildTestContext(t)
+	defer teardown()
 
-		tc.gf.Bucket = errorBucket
-		tc.gf.Object = efile4
+	tc.gf.Bucket = errorBucket
+	tc.gf.Object = efile4
 
-		tc.gf.fetchFromZip(context.Background())
-		return
-	}
-	cmd := exec.Command(os.Args[0], "-test.run=^TestFetchFromZipPermissionDenied$")
-	cmd.Env = append(os.Environ(), "subprocess=1")
-	err := cmd.Run()
-	if err == nil {
-		t.Fatal("fetchFromZip() unexpectedly exited with success")
-	}
-	exitError, ok := err.(*exec.ExitError)
-	if !ok {
-		t.Fatal("fetchFromZip() unexpectedly exited with unknown error")
-	}
-	exitCode := exitError.ExitCode()
-	if exitCode != permissionDeniedExitStatus {
-		t.Fatalf("fetchFromZip() exited with wrong status, got %v, want %v", exitCode, permissionDeniedExitStatus)
+	err := tc.gf.fetchFromArchive(context.Background(), "ZipArchive")
+	var perr *PermissionError
+	if !errors.As(err, &perr) {
+		t.Fatalf("fetchFromArchive() got %v, want PermissionError", err)
 	}
 }
 
 func TestFetchFromTarGzPermissionDenied(t *testing.T) {
-	if os.Getenv("subprocess") == "1" {
-		tc, teardown := buildTestContext(t)
-		defer teardown()
+	tc, teardown := buildTestContext(t)
+	defer teardown()
 
-		tc.gf.Bucket = errorBucket
-		tc.gf.Object = efile4
+	tc.gf.Bucket = errorBucket
+	tc.gf.Object = efile4
 
-		tc.gf.fetchFromTarGz(context.Background())
-		return
+	err := tc.gf.fetchFromArchive(context.Background(), "TarGzArchive")
+	var perr *PermissionError
+	if !errors.As(err, &perr) {
+		t.Fatalf("fetchFromArchive() got %v, want PermissionError", err)
 	}
-	cmd := exec.Command(os.Args[0], "-test.run=^TestFetchFromTarGzPermissionDenied$")
-	cmd.Env = append(os.Environ(), "subprocess=1")
-	err := cmd.Run()
-	if err == nil {
-		t.Fatal("fetchFromTarGz() unexpectedly exited with success")
+}
+
+func TestFetchFromManifestChecksumMismatch(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	manifest := "bad-sha-manifest.json"
+	tc.gcs.objects[formatGCSName(successBucket, manifest, generation)] = fakeGCSResponse{content: []byte(`{
+		"sfile1.js": {"sourceUrl": "gs://success-bucket/sfile1.js", "sha1sum": "0000000000000000000000000000000000000000"},
+		"sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+	}`)}
+	tc.gf.Object = manifest
+
+	err := tc.gf.fetchFromManifest(context.Background())
+	var ferr *FetchError
+	if !errors.As(err, &ferr) || len(ferr.Errs) != 1 {
+		t.Fatalf("fetchFromManifest() got %v, want FetchError with 1 error", err)
 	}
-	exitError, ok := err.(*exec.ExitError)
-	if !ok {
-		t.Fatal("fetchFromTarGz() unexpectedly exited with unknown error")
+	var cerr *ChecksumError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("fetchFromManifest() got %v, want ChecksumError", err)
+	}
+	if cerr.Filename != "sfile1.js" || cerr.Algorithm != "SHA1" || cerr.Want != "0000000000000000000000000000000000000000" {
+		t.Errorf("fetchFromManifest() got %+v, want SHA1 mismatch for sfile1.js", cerr)
+	}
+}
+
+func TestFetchObjectTimeoutExhausted(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+	tc.gf.Retries = 0
+
+	j := job{bucket: errorBucket, object: efile3, filename: "efile3.js"} // efile3 is a slow GCS read
+	report := tc.gf.fetchObject(context.Background(), j)
+	var terr *TimeoutError
+	if !errors.As(report.err, &terr) {
+		t.Fatalf("fetchObject() got err %v, want TimeoutError", report.err)
 	}
-	exitCode := exitError.ExitCode()
-	if exitCode != permissionDeniedExitStatus {
-		t.Fatalf("fetchFromTarGz() exited with wrong status, got %v, want %v", exitCode, permissionDeniedExitStatus)
+	if terr.Attempts != 1 || terr.Timeout != sourceTimeout[0] || terr.Filename != "efile3.js" {
+		t.Errorf("fetchObject() got %+v, want 1 attempt with timeout %v for efile3.js", terr, sourceTimeout[0])
 	}
 }
 
@@ -810,6 +864,41 @@ func TestFetchFromManifestSuccess(t *testing.T) {
 	}
 }
 
+func TestFetchFromManifestRestoresModes(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	tc.gf.Bucket = successBucket
+	tc.gf.Object = modeManifest
+
+	if err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+		t.Fatalf("fetchFromManifest() got %v, want nil", err)
+	}
+
+	for _, c := range []struct {
+		filename string
+		mode     os.FileMode
+		mtime    time.Time
+	}{
+		{"writable.js", 0644, time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)},
+		{"bin/tool", 0755, time.Time{}},
+		{"legacy/sfile3", defaultFileMode, time.Time{}},
+	} {
+		name := filepath.Join(tc.gf.DestDir, c.filename)
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Errorf("Stat(%v) err = %v, want nil", name, err)
+			continue
+		}
+		if info.Mode() != c.mode {
+			t.Errorf("%s mode got %v, want %v", c.filename, info.Mode(), c.mode)
+		}
+		if !c.mtime.IsZero() && !info.ModTime().Equal(c.mtime) {
+			t.Errorf("%s mtime got %v, want %v", c.filename, info.ModTime(), c.mtime)
+		}
+	}
+}
+
 func TestFetchFromManifestManifestFetchFailed(t *testing.T) {
 	tc, teardown := buildTestContext(t)
 	defer teardown()
@@ -848,31 +937,6 @@ func TestFetchFromManifestManifestFileReadFailed(t *testing.T) {
 	}
 }
 
-func TestTimeout(t *testing.T) {
-	tests := []struct {
-		filename string
-		retrynum int
-		want     time.Duration
-	}{
-		{"source.js", 0, sourceTimeout[0]},
-		{"source.js", 1, sourceTimeout[1]},
-		{"source.js", 2, defaultTimeout},
-		{"not-source.mpg", 0, notSourceTimeout[0]},
-		{"not-source.mpg", 1, notSourceTimeout[1]},
-		{"not-source.mpg", 2, defaultTimeout},
-		{"no-extension", 0, notSourceTimeout[0]},
-		{"no-extension", 1, notSourceTimeout[1]},
-		{"no-extension", 2, defaultTimeout},
-	}
-	tc, teardown := buildTestContext(t)
-	defer teardown()
-	for _, test := range tests {
-		got := tc.gf.timeout(test.filename, test.retrynum)
-		if got != test.want {
-			t.Errorf("getTimeout(%v, %v) got %v, want %v", test.filename, test.retrynum, got, test.want)
-		}
-	}
-}
 
 func TestUnzip(t *testing.T) {
 	type zipEntry struct {
@@ -983,7 +1047,9 @@ func TestUnzip(t *testing.T) {
 			}
 
 			// Unzip the archive (this is the function under test).
-			_, err = unzip(zipfile, dest)
+			if err := unzip(zipfile, newExtractor(dest)); err != nil {
+				t.Fatalf("unzip() got %v, want nil", err)
+			}
 
 			// Walk the unzip folder and store the unzipped results for comparison.
 			got := make(map[string]zipEntry)
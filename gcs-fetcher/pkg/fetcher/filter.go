@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathFilter selects the manifest entries and archive entries to fetch by
+// their path. Patterns are slash-separated globs as understood by path.Match,
+// in which a "**" segment matches any number of path segments, including
+// none. A pattern that matches a directory also matches everything below it.
+//
+// A path is selected if it matches any include pattern, or if there are none,
+// and matches no exclude pattern. A nil pathFilter selects every path.
+type pathFilter struct {
+	include, exclude [][]string
+}
+
+// newPathFilter returns a filter for the given patterns, or nil if there are
+// none.
+func newPathFilter(include, exclude []string) (*pathFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	f := &pathFilter{}
+	for _, p := range []struct {
+		patterns []string
+		dest     *[][]string
+	}{
+		{include, &f.include},
+		{exclude, &f.exclude},
+	} {
+		for _, pattern := range p.patterns {
+			segments := splitPath(pattern)
+			for _, s := range segments {
+				if _, err := path.Match(s, ""); err != nil {
+					return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+				}
+			}
+			*p.dest = append(*p.dest, segments)
+		}
+	}
+	return f, nil
+}
+
+// splitPath returns the segments of the clean, slash-separated form of name.
+func splitPath(name string) []string {
+	name = path.Clean(filepath.ToSlash(name))
+	name = strings.TrimPrefix(name, "/")
+	if name == "." || name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// match reports whether the path name is selected.
+func (f *pathFilter) match(name string) bool {
+	if f == nil {
+		return true
+	}
+	segments := splitPath(name)
+	included := len(f.include) == 0
+	for _, pattern := range f.include {
+		if matchSegments(pattern, segments) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range f.exclude {
+		if matchSegments(pattern, segments) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSegments reports whether the path segments name match the pattern
+// segments pattern, or have a parent directory that does.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return true
+}
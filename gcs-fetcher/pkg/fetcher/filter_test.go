@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPathFilter(t *testing.T) {
+	for _, c := range []struct {
+		include, exclude []string
+		name             string
+		want             bool
+	}{
+		{nil, nil, "any/file", true},
+		{[]string{"services/foo/**"}, nil, "services/foo/main.go", true},
+		{[]string{"services/foo/**"}, nil, "services/foo/a/b/c.go", true},
+		{[]string{"services/foo/**"}, nil, "services/foo", true},
+		{[]string{"services/foo/**"}, nil, "services/bar/main.go", false},
+		{[]string{"services/foo/**"}, nil, "services/foobar/main.go", false},
+		{[]string{"services/foo"}, nil, "services/foo/main.go", true},
+		{[]string{"services/foo/**", "proto/**"}, nil, "proto/api.proto", true},
+		{[]string{"**/*.go"}, nil, "main.go", true},
+		{[]string{"**/*.go"}, nil, "a/b/main.go", true},
+		{[]string{"**/*.go"}, nil, "a/b/main.js", false},
+		{[]string{"services/*/BUILD"}, nil, "services/foo/BUILD", true},
+		{[]string{"services/*/BUILD"}, nil, "services/foo/bar/BUILD", false},
+		{[]string{"a/**/z"}, nil, "a/z", true},
+		{[]string{"a/**/z"}, nil, "a/b/c/z", true},
+		{nil, []string{"**/testdata"}, "pkg/testdata/file", false},
+		{nil, []string{"**/testdata"}, "pkg/data/file", true},
+		{[]string{"services/**"}, []string{"services/*/vendor"}, "services/foo/vendor/x.go", false},
+		{[]string{"services/**"}, []string{"services/*/vendor"}, "services/foo/main.go", true},
+		{[]string{"./dir/"}, nil, "dir/file.txt", true},
+		{[]string{"dir"}, nil, "./dir/file.txt", true},
+	} {
+		f, err := newPathFilter(c.include, c.exclude)
+		if err != nil {
+			t.Fatalf("newPathFilter(%q, %q) got %v, want nil", c.include, c.exclude, err)
+		}
+		if got := f.match(c.name); got != c.want {
+			t.Errorf("match(%q) with include %q and exclude %q got %v, want %v", c.name, c.include, c.exclude, got, c.want)
+		}
+	}
+
+	if _, err := newPathFilter([]string{"a/[b"}, nil); err == nil {
+		t.Errorf("newPathFilter(%q) got nil, want error", "a/[b")
+	}
+}
+
+func TestFetchFromManifestFilters(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	tc.gf.Object = modeManifest
+	tc.gf.Include = []string{"bin/**", "legacy"}
+	tc.gf.Exclude = []string{"legacy/sfile3"}
+	var buf strings.Builder
+	tc.gf.Stdout = &buf
+
+	if err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+		t.Fatalf("fetchFromManifest() got %v, want nil", err)
+	}
+	if got, want := strings.Join(listFiles(t, tc.gf.DestDir), ","), "bin,bin/tool"; got != want {
+		t.Errorf("files after fetchFromManifest() got %v, want %v", got, want)
+	}
+	if !strings.Contains(buf.String(), "Filtered files:         2") {
+		t.Errorf("fetchFromManifest() got summary %s, want 2 filtered files", buf.String())
+	}
+	if tc.gf.report.Totals.FilteredFiles != 2 {
+		t.Errorf("fetchFromManifest() got %d filtered files in report, want 2", tc.gf.report.Totals.FilteredFiles)
+	}
+}
+
+func TestUntarFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	x := newExtractor(dir)
+	if x.filter, err = newPathFilter([]string{"first/**", "keep.txt"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := untar(tar.NewReader(buildTar(t, streamTarEntries)), x); err != nil {
+		t.Fatalf("untar() got %v, want nil", err)
+	}
+	if got, want := strings.Join(listFiles(t, dir), ","), "first,first/a.txt,keep.txt"; got != want {
+		t.Errorf("files after untar() got %v, want %v", got, want)
+	}
+	if x.filtered != 1 || x.entries != 3 {
+		t.Errorf("untar() got %d filtered and %d extracted entries, want 1 and 3", x.filtered, x.entries)
+	}
+
+	// Hard links cannot point to entries that were filtered out.
+	x = newExtractor(dir)
+	if x.filter, err = newPathFilter(nil, []string{"second"}); err != nil {
+		t.Fatal(err)
+	}
+	entries := append(streamTarEntries, tarEntry{header: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "second/b.txt"}})
+	if err := untar(tar.NewReader(buildTar(t, entries)), x); err == nil || !strings.Contains(err.Error(), "not selected") {
+		t.Errorf("untar() got %v, want error for link to filtered entry", err)
+	}
+}
+
+func TestUnzipFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipfile := filepath.Join(dir, "source.zip")
+	if err := ioutil.WriteFile(zipfile, buildArchive(t, "ZipArchive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	x := newExtractor(dest)
+	if x.filter, err = newPathFilter(nil, []string{"**/*.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := unzip(zipfile, x); err != nil {
+		t.Fatalf("unzip() got %v, want nil", err)
+	}
+	if x.numFiles != 0 || x.filtered != 1 {
+		t.Errorf("unzip() got %d files and %d filtered, want 0 and 1", x.numFiles, x.filtered)
+	}
+}
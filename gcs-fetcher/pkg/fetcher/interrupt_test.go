@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// blockingGCS serves the manifest from fakeGCS, and readers of every other
+// object that block until their context is done.
+type blockingGCS struct {
+	*fakeGCS
+	manifest string
+	closed   chan string
+}
+
+func (f *blockingGCS) NewReader(ctx context.Context, bucket, object string, gen int64) (io.ReadCloser, error) {
+	if object == f.manifest {
+		return f.fakeGCS.NewReader(ctx, bucket, object, gen)
+	}
+	return &blockingReader{ctx: ctx, object: object, closed: f.closed}, nil
+}
+
+type blockingReader struct {
+	ctx    context.Context
+	object string
+	closed chan<- string
+}
+
+func (r *blockingReader) Read([]byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func (r *blockingReader) Close() error {
+	r.closed <- r.object
+	return nil
+}
+
+func TestFetchInterrupted(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	gcs := &blockingGCS{fakeGCS: tc.gcs, manifest: goodManifest, closed: make(chan string, 3)}
+	tc.gf.GCS = gcs
+	tc.gf.SourceType = "Manifest"
+	tc.gf.TimeoutGCS = false
+	var buf bytes.Buffer
+	tc.gf.ReportWriter = &buf
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := tc.gf.Fetch(ctx)
+	var ierr *InterruptedError
+	if !errors.As(err, &ierr) || ierr.Cause != context.DeadlineExceeded {
+		t.Fatalf("Fetch() got %v, want InterruptedError for %v", err, context.DeadlineExceeded)
+	}
+
+	// The in-flight readers stop, and their temp files are removed.
+	for i := 0; i < tc.gf.WorkerCount; i++ {
+		select {
+		case <-gcs.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Fetch() left %d readers open, want 0", tc.gf.WorkerCount-i)
+		}
+	}
+	if _, err := os.Stat(tc.gf.StagingDir); !os.IsNotExist(err) {
+		t.Errorf("Fetch() left staging dir %s: %v", tc.gf.StagingDir, err)
+	}
+
+	var rep Report
+	if err := json.Unmarshal(buf.Bytes(), &rep); err != nil {
+		t.Fatalf("json.Unmarshal(report) got %v", err)
+	}
+	if rep.Status != "INTERRUPTED" || rep.Source == nil || !rep.Source.Success {
+		t.Errorf("Fetch() wrote report with status %q and source %+v, want INTERRUPTED after fetching the manifest", rep.Status, rep.Source)
+	}
+}
+
+func TestProcessJobsSkipsJobsWhenCancelled(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	jobs := []job{
+		{filename: "a", bucket: successBucket, object: sfile1},
+		{filename: "b", bucket: successBucket, object: sfile2},
+	}
+	stats := tc.gf.processJobs(ctx, jobs)
+	if stats.success || stats.files != 0 {
+		t.Errorf("processJobs() got success %v for %d files, want false for 0", stats.success, stats.files)
+	}
+	if len(stats.errs) != 1 || !errors.Is(stats.errs[0], context.Canceled) {
+		t.Errorf("processJobs() got errors %v, want %v", stats.errs, context.Canceled)
+	}
+}
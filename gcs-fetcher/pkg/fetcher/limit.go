@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limits throttles the downloads of a fetch to a total number of bytes per
+// second, and to a number of concurrent downloads from each bucket, so that
+// a fetch neither saturates the network of the machine nor trips the request
+// limits of a bucket. It keeps track of the time that downloads were held
+// back. A nil *limits does not limit anything.
+type limits struct {
+	bandwidth *rate.Limiter // nil if unlimited.
+	perBucket int           // Zero if unlimited.
+
+	mu      sync.Mutex
+	buckets map[string]chan struct{}
+
+	// bandwidthWait and bucketWait are the nanoseconds that downloads waited for
+	// bandwidth and for a bucket slot respectively, summed over all workers.
+	bandwidthWait, bucketWait int64
+}
+
+// newLimits returns the limits for the given number of bytes per second and
+// concurrent downloads per bucket, either of which may be zero for no limit.
+// It returns nil if neither is limited.
+func newLimits(bytesPerSecond int64, perBucket int) *limits {
+	if bytesPerSecond <= 0 && perBucket <= 0 {
+		return nil
+	}
+	l := &limits{perBucket: perBucket, buckets: map[string]chan struct{}{}}
+	if bytesPerSecond > 0 {
+		// Allow up to one second worth of bytes at once.
+		l.bandwidth = rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))
+	}
+	return l
+}
+
+// reader returns a reader of r that is throttled to the bandwidth limit.
+func (l *limits) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil || l.bandwidth == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+// acquire waits until fewer than the limit of downloads from bucket are in
+// flight, or until ctx is done, in which case it returns ctx.Err(). The
+// returned func must be called once the download is over.
+func (l *limits) acquire(ctx context.Context, bucket string) (release func(), err error) {
+	if l == nil || l.perBucket <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	slots, ok := l.buckets[bucket]
+	if !ok {
+		slots = make(chan struct{}, l.perBucket)
+		l.buckets[bucket] = slots
+	}
+	l.mu.Unlock()
+
+	started := time.Now()
+	defer func() {
+		atomic.AddInt64(&l.bucketWait, int64(time.Since(started)))
+	}()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// bandwidthWaitTime and bucketWaitTime return the time that downloads waited
+// for bandwidth and for a bucket slot so far, summed over all workers.
+func (l *limits) bandwidthWaitTime() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&l.bandwidthWait))
+}
+
+func (l *limits) bucketWaitTime() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&l.bucketWait))
+}
+
+// logLimits adds the time that downloads were held back by the limits to
+// the final summary.
+func (gf *Fetcher) logLimits() {
+	if gf.MaxBytesPerSecond > 0 {
+		gf.log("Bandwidth waits:   %9.2f s", gf.limits.bandwidthWaitTime().Seconds())
+	}
+	if gf.MaxPerBucket > 0 {
+		gf.log("Bucket waits:      %9.2f s", gf.limits.bucketWaitTime().Seconds())
+	}
+}
+
+// limitedReader is a reader throttled to the bandwidth limit of l.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *limits
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// Never read more than the limiter allows at once.
+	if burst := r.l.bandwidth.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		started := time.Now()
+		if werr := r.l.bandwidth.WaitN(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+		atomic.AddInt64(&r.l.bandwidthWait, int64(time.Since(started)))
+	}
+	return n, err
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewLimits(t *testing.T) {
+	if l := newLimits(0, 0); l != nil {
+		t.Errorf("newLimits(0, 0) got %+v, want nil", l)
+	}
+	var l *limits
+	r := bytes.NewReader(nil)
+	if got := l.reader(context.Background(), r); got != r {
+		t.Errorf("nil limits reader() got %v, want the reader itself", got)
+	}
+	release, err := l.acquire(context.Background(), successBucket)
+	if err != nil {
+		t.Fatalf("nil limits acquire() got %v, want nil", err)
+	}
+	release()
+}
+
+func TestLimitsBandwidth(t *testing.T) {
+	l := newLimits(10000, 0)
+	started := time.Now()
+	// The first second worth of bytes is allowed at once, the rest is
+	// throttled.
+	n, err := io.Copy(ioutil.Discard, l.reader(context.Background(), bytes.NewReader(make([]byte, 15000))))
+	if err != nil || n != 15000 {
+		t.Fatalf("io.Copy() got (%d, %v), want (15000, nil)", n, err)
+	}
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond {
+		t.Errorf("reading 15000 bytes at 10000 bytes/s took %v, want at least 500ms", elapsed)
+	}
+	if got := l.bandwidthWaitTime(); got < 400*time.Millisecond {
+		t.Errorf("bandwidthWaitTime() got %v, want at least 500ms", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := io.Copy(ioutil.Discard, l.reader(ctx, bytes.NewReader(make([]byte, 15000)))); err == nil {
+		t.Errorf("io.Copy() with cancelled context got nil, want error")
+	}
+}
+
+func TestLimitsPerBucket(t *testing.T) {
+	l := newLimits(0, 1)
+	release, err := l.acquire(context.Background(), successBucket)
+	if err != nil {
+		t.Fatalf("acquire(%s) got %v, want nil", successBucket, err)
+	}
+	// Other buckets are not held up.
+	if other, err := l.acquire(context.Background(), errorBucket); err != nil {
+		t.Errorf("acquire(%s) got %v, want nil", errorBucket, err)
+	} else {
+		other()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx, successBucket); err != context.DeadlineExceeded {
+		t.Errorf("acquire(%s) with a download in flight got %v, want %v", successBucket, err, context.DeadlineExceeded)
+	}
+	release()
+	if again, err := l.acquire(context.Background(), successBucket); err != nil {
+		t.Errorf("acquire(%s) after release got %v, want nil", successBucket, err)
+	} else {
+		again()
+	}
+	if got := l.bucketWaitTime(); got < 50*time.Millisecond {
+		t.Errorf("bucketWaitTime() got %v, want at least 50ms", got)
+	}
+}
+
+// concurrencyGCS records the largest number of concurrent reads of fakeGCS
+// objects.
+type concurrencyGCS struct {
+	*fakeGCS
+	mu             sync.Mutex
+	inFlight, most int
+}
+
+func (f *concurrencyGCS) NewReader(ctx context.Context, bucket, object string, gen int64) (io.ReadCloser, error) {
+	r, err := f.fakeGCS.NewReader(ctx, bucket, object, gen)
+	if err != nil {
+		return r, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.inFlight++; f.inFlight > f.most {
+		f.most = f.inFlight
+	}
+	return &concurrencyReader{ReadCloser: r, f: f}, nil
+}
+
+type concurrencyReader struct {
+	io.ReadCloser
+	f *concurrencyGCS
+}
+
+func (r *concurrencyReader) Read(p []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	return r.ReadCloser.Read(p)
+}
+
+func (r *concurrencyReader) Close() error {
+	r.f.mu.Lock()
+	r.f.inFlight--
+	r.f.mu.Unlock()
+	return r.ReadCloser.Close()
+}
+
+func TestProcessJobsPerBucketLimit(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	gcs := &concurrencyGCS{fakeGCS: tc.gcs}
+	tc.gf.GCS = gcs
+	tc.gf.WorkerCount = 4
+	tc.gf.MaxPerBucket = 1
+	tc.gf.limits = newLimits(0, tc.gf.MaxPerBucket)
+	var jobs []job
+	for _, name := range []string{"a", "b", "c", "d"} {
+		jobs = append(jobs, job{filename: name, bucket: successBucket, object: sfile1})
+	}
+	stats := tc.gf.processJobs(context.Background(), jobs)
+	if !stats.success {
+		t.Fatalf("processJobs() got errors %v, want none", stats.errs)
+	}
+	if gcs.most != 1 {
+		t.Errorf("processJobs() read %d objects of %s at once, want 1", gcs.most, successBucket)
+	}
+	if tc.gf.limits.bucketWaitTime() == 0 {
+		t.Errorf("processJobs() bucket wait time got 0, want more")
+	}
+}
+
+func TestTimeoutWithBandwidthLimit(t *testing.T) {
+	gf := &Fetcher{TimeoutGCS: true, WorkerCount: 10, MaxBytesPerSecond: 1 << 20}
+	// Each worker gets 0.1 MiB/s, so a 1 MiB file is expected to take 10s.
+	if got, want := gf.timeout(job{filename: "f", size: 1 << 20}, 0), latencyTimeout[0]+40*time.Second; got != want {
+		t.Errorf("timeout() got %v, want %v", got, want)
+	}
+	if got := gf.timeout(job{filename: "f.js"}, 0); got != defaultTimeout {
+		t.Errorf("timeout() of a file of unknown size got %v, want %v", got, defaultTimeout)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+)
+
+// gzipMagic are the leading bytes of gzip compressed manifests.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// fetchManifest downloads the manifest file to gf.StagingDir, and returns the
+// report of the download.
+func (gf *Fetcher) fetchManifest(ctx context.Context) (*jobReport, error) {
+	gf.log("Fetching manifest %s.", formatGCSName(gf.Bucket, gf.Object, gf.Generation))
+	j := job{
+		filename:        gf.Object,
+		bucket:          gf.Bucket,
+		object:          gf.Object,
+		generation:      gf.Generation,
+		destDirOverride: gf.StagingDir,
+		awaitVisible:    true,
+	}
+	// Override the retry/backoff to span an up-to-11 second eventual consistency
+	// issue on new project creation. We'll only do this for the first file
+	// (the manifest), and then drop back to the original retry/backoff.
+	oretries, obackoff := gf.Retries, gf.Backoff
+	gf.Retries, gf.Backoff = 6, 1*time.Second // Yields 1s, 2s, 4s, 8s, 16s
+	report := gf.fetchObject(ctx, j)
+	gf.Retries, gf.Backoff = oretries, obackoff
+	gf.report.Source = newFileReport(report)
+	if !report.success {
+		return report, fmt.Errorf("failed to download manifest %s: %w", formatGCSName(gf.Bucket, gf.Object, gf.Generation), report.err)
+	}
+	return report, nil
+}
+
+// readManifest decodes the manifest file fetched by fetchManifest, which may
+// be gzip compressed, and calls fn with the job for every file selected by
+// gf.filter, in the order of the manifest. The manifest is decoded as it is
+// read, so fn is called for the first files long before a large manifest
+// has been read in full. readManifest stops at the first error returned by
+// fn, and returns it. Otherwise, it returns the number of files that were
+// filtered out.
+func (gf *Fetcher) readManifest(fn func(job) error) (filtered int, err error) {
+	manifestFile := filepath.Join(gf.StagingDir, gf.Object)
+	f, err := gf.OS.Open(manifestFile)
+	if err != nil {
+		return 0, fmt.Errorf("opening manifest file %q: %v", manifestFile, err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Failed to close file %q: %v", manifestFile, cerr)
+		}
+	}()
+
+	var r io.Reader = bufio.NewReader(f)
+	if header, _ := r.(*bufio.Reader).Peek(len(gzipMagic)); bytes.Equal(header, gzipMagic) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, fmt.Errorf("decompressing manifest file %q: %v", manifestFile, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	err = decodeManifest(r, func(filename string, info common.ManifestItem) error {
+		if !gf.filter.match(filename) {
+			filtered++
+			return nil
+		}
+		bucket, object, generation, err := common.ParseSourceURL(info.SourceURL)
+		if err != nil {
+			return fmt.Errorf("parsing bucket/object from %q: %v", info.SourceURL, err)
+		}
+		if _, err := gf.backend(bucket); err != nil {
+			return fmt.Errorf("fetching %q: %v", info.SourceURL, err)
+		}
+		j := job{
+			filename:   filename,
+			bucket:     bucket,
+			object:     object,
+			generation: generation,
+			sha1sum:    info.Sha1Sum,
+			sha256sum:  info.Sha256Sum,
+			mode:       info.FileMode,
+			size:       info.Size,
+		}
+		if info.ModTime != nil {
+			j.mtime = *info.ModTime
+		}
+		return fn(j)
+	})
+	if err != nil {
+		return filtered, fmt.Errorf("decoding JSON from manifest file %q: %w", manifestFile, err)
+	}
+	return filtered, nil
+}
+
+// decodeManifest decodes the JSON manifest read from r one entry at a time,
+// and calls fn with each of them. It stops at the first error returned by fn.
+func decodeManifest(r io.Reader, fn func(filename string, info common.ManifestItem) error) error {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return fmt.Errorf("got %v, want a JSON object", t)
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		filename := t.(string) // Object keys are always strings.
+		var info common.ManifestItem
+		if err := dec.Decode(&info); err != nil {
+			return fmt.Errorf("entry %q: %v", filename, err)
+		}
+		if err := fn(filename, info); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// loadManifest fetches the manifest file and decodes it into the jobs for the
+// files selected by gf.Include and gf.Exclude. It also returns the number of
+// files that were filtered out, and the report of the manifest download.
+func (gf *Fetcher) loadManifest(ctx context.Context) (jobs []job, filtered int, report *jobReport, err error) {
+	if gf.filter, err = newPathFilter(gf.Include, gf.Exclude); err != nil {
+		return nil, 0, nil, err
+	}
+	if report, err = gf.fetchManifest(ctx); err != nil {
+		return nil, 0, report, err
+	}
+	filtered, err = gf.readManifest(func(j job) error {
+		jobs = append(jobs, j)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, report, err
+	}
+	return jobs, filtered, report, nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+)
+
+func TestDecodeManifest(t *testing.T) {
+	errStop := errors.New("stop")
+	for _, c := range []struct {
+		name     string
+		manifest string
+		stopAt   string
+		want     []string
+		wantErr  bool
+	}{
+		{"empty", `{}`, "", nil, false},
+		{"ordered", `{"b": {"sourceUrl": "gs://b/1"}, "a": {"sourceUrl": "gs://b/2"}}`, "", []string{"b:gs://b/1", "a:gs://b/2"}, false},
+		{"stopped", `{"b": {"sourceUrl": "gs://b/1"}, "a": {"sourceUrl": "gs://b/2"}}`, "b", []string{"b:gs://b/1"}, true},
+		{"truncated", `{"b": {"sourceUrl": "gs://b/1"}, "a": {"sourceU`, "", []string{"b:gs://b/1"}, true},
+		{"bad entry", `{"b": {"sourceUrl": 1}}`, "", nil, true},
+		{"not an object", `["b"]`, "", nil, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			err := decodeManifest(strings.NewReader(c.manifest), func(filename string, info common.ManifestItem) error {
+				got = append(got, filename+":"+info.SourceURL)
+				if filename == c.stopAt {
+					return errStop
+				}
+				return nil
+			})
+			if (err != nil) != c.wantErr {
+				t.Errorf("decodeManifest() got error %v, want error %v", err, c.wantErr)
+			}
+			if c.stopAt != "" && err != errStop {
+				t.Errorf("decodeManifest() got error %v, want %v", err, errStop)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("decodeManifest() got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDecodeManifestStreams(t *testing.T) {
+	r, w := io.Pipe()
+	entries := make(chan string)
+	done := make(chan error)
+	go func() {
+		done <- decodeManifest(r, func(filename string, info common.ManifestItem) error {
+			entries <- filename
+			return nil
+		})
+		close(entries)
+	}()
+
+	// The first entry is decoded before the rest of the manifest is written.
+	go w.Write([]byte(`{"a": {"sourceUrl": "gs://b/1"}, `))
+	if got := <-entries; got != "a" {
+		t.Errorf("decodeManifest() got entry %q, want %q", got, "a")
+	}
+	go func() {
+		w.Write([]byte(`"b": {"sourceUrl": "gs://b/2"}}`))
+		w.Close()
+	}()
+	if got := <-entries; got != "b" {
+		t.Errorf("decodeManifest() got entry %q, want %q", got, "b")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("decodeManifest() got %v, want nil", err)
+	}
+}
+
+func TestFetchFromManifestGzip(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(goodManifestContents)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	manifest := "manifest.json.gz"
+	tc.gcs.objects[formatGCSName(successBucket, manifest, generation)] = fakeGCSResponse{content: buf.Bytes()}
+	tc.gf.Object = manifest
+
+	if err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+		t.Fatalf("fetchFromManifest() got %v, want nil", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tc.workDir, sfile1))
+	if err != nil || !bytes.Equal(got, sfile1Contents) {
+		t.Errorf("fetchFromManifest() wrote %s %q (%v), want %q", sfile1, got, err, sfile1Contents)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProgressEvent is a snapshot of the progress of a fetch, see
+// Fetcher.ProgressInterval.
+type ProgressEvent struct {
+	Time       time.Time `json:"time"`
+	FilesDone  int       `json:"filesDone"`
+	FilesTotal int       `json:"filesTotal"`
+
+	// Listing is set while the manifest is still being read, in which case
+	// FilesTotal and BytesTotal only count the files listed so far.
+	Listing bool `json:"listing,omitempty"`
+
+	// BytesDone counts the bytes of the files that are done, and of the
+	// downloads in flight. BytesTotal is zero if the size of any file is
+	// unknown.
+	BytesDone  int64 `json:"bytesDone"`
+	BytesTotal int64 `json:"bytesTotal,omitempty"`
+
+	MiBPerSecond float64 `json:"mibPerSecond"`
+	ETASeconds   float64 `json:"etaSeconds,omitempty"` // Zero if unknown.
+	Retries      int     `json:"retries"`
+
+	// SlowestInFlight is the download that has been in flight the longest.
+	SlowestInFlight        string  `json:"slowestInFlight,omitempty"`
+	SlowestInFlightSeconds float64 `json:"slowestInFlightSeconds,omitempty"`
+}
+
+func (e ProgressEvent) String() string {
+	files := fmt.Sprintf("%d/%d", e.FilesDone, e.FilesTotal)
+	if e.Listing {
+		files += "+"
+	}
+	bytes := fmt.Sprintf("%.1f MiB", float64(e.BytesDone)/1024/1024)
+	if e.BytesTotal > 0 {
+		bytes = fmt.Sprintf("%.1f/%.1f MiB", float64(e.BytesDone)/1024/1024, float64(e.BytesTotal)/1024/1024)
+	}
+	parts := []string{files + " files", bytes, fmt.Sprintf("%.2f MiB/s", e.MiBPerSecond)}
+	if e.ETASeconds > 0 {
+		parts = append(parts, fmt.Sprintf("ETA %v", time.Duration(e.ETASeconds*float64(time.Second)).Round(time.Second)))
+	}
+	parts = append(parts, fmt.Sprintf("%d retries", e.Retries))
+	if e.SlowestInFlight != "" {
+		parts = append(parts, fmt.Sprintf("slowest in flight: %s (%v)", e.SlowestInFlight, time.Duration(e.SlowestInFlightSeconds*float64(time.Second)).Round(time.Second)))
+	}
+	return "Progress: " + strings.Join(parts, ", ")
+}
+
+// progress keeps track of the files of a fetch and the downloads in flight,
+// for periodic progress reports. A nil *progress tracks nothing.
+type progress struct {
+	started time.Time
+
+	mu         sync.Mutex
+	filesTotal int
+	filesDone  int
+	listing    bool
+	bytesTotal int64
+	unsized    int   // Files of unknown size.
+	bytesDone  int64 // Bytes of the files that are done.
+	retries    int
+	inFlight   map[*transfer]bool
+}
+
+func newProgress(listing bool) *progress {
+	return &progress{started: time.Now(), listing: listing, inFlight: map[*transfer]bool{}}
+}
+
+// transfer is a download in flight. It counts the bytes read by its current
+// attempt. A nil *transfer counts nothing.
+type transfer struct {
+	name    string
+	started time.Time
+	n       int64
+}
+
+// queue adds job j to the files of the fetch.
+func (p *progress) queue(j job) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filesTotal++
+	if j.size > 0 {
+		p.bytesTotal += j.size
+	} else {
+		p.unsized++
+	}
+}
+
+// listed records that all files of the fetch have been queued.
+func (p *progress) listed() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.listing = false
+	p.mu.Unlock()
+}
+
+// retry records that a failed attempt is retried.
+func (p *progress) retry() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.retries++
+	p.mu.Unlock()
+}
+
+// done records that the file of report is done, whether it succeeded or
+// not. Its downloaded bytes are recorded by finish, the bytes taken from the
+// cache or copied from a duplicate here.
+func (p *progress) done(report *jobReport) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filesDone++
+	p.bytesDone += int64(report.cached + report.copied)
+}
+
+// start records that the download of job j is in flight.
+func (p *progress) start(j job) *transfer {
+	if p == nil {
+		return nil
+	}
+	t := &transfer{name: formatGCSName(j.bucket, j.object, j.generation), started: time.Now()}
+	p.mu.Lock()
+	p.inFlight[t] = true
+	p.mu.Unlock()
+	return t
+}
+
+// finish records that the download t, with the given report, is over.
+func (p *progress) finish(t *transfer, report *jobReport) {
+	if p == nil || t == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inFlight, t)
+	if report.success {
+		p.bytesDone += int64(report.size)
+	}
+}
+
+// restart discards the bytes read by the previous attempt of t.
+func (t *transfer) restart() {
+	if t != nil {
+		atomic.StoreInt64(&t.n, 0)
+	}
+}
+
+// reader returns a reader of r that counts the bytes read towards t.
+func (t *transfer) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &transferReader{r: r, t: t}
+}
+
+type transferReader struct {
+	r io.Reader
+	t *transfer
+}
+
+func (tr *transferReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	atomic.AddInt64(&tr.t.n, int64(n))
+	return n, err
+}
+
+// snapshot returns the progress at now.
+func (p *progress) snapshot(now time.Time) ProgressEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := ProgressEvent{
+		Time:       now,
+		FilesDone:  p.filesDone,
+		FilesTotal: p.filesTotal,
+		Listing:    p.listing,
+		BytesDone:  p.bytesDone,
+		Retries:    p.retries,
+	}
+	var slowest *transfer
+	for t := range p.inFlight {
+		e.BytesDone += atomic.LoadInt64(&t.n)
+		if slowest == nil || t.started.Before(slowest.started) {
+			slowest = t
+		}
+	}
+	if slowest != nil {
+		e.SlowestInFlight = slowest.name
+		e.SlowestInFlightSeconds = now.Sub(slowest.started).Seconds()
+	}
+	if p.unsized == 0 {
+		e.BytesTotal = p.bytesTotal
+	}
+
+	elapsed := now.Sub(p.started).Seconds()
+	if elapsed > 0 {
+		e.MiBPerSecond = float64(e.BytesDone) / 1024 / 1024 / elapsed
+	}
+	// Estimate the time left by the bytes left if their number is known, or
+	// else by the files left.
+	switch {
+	case p.listing || elapsed <= 0:
+	case e.BytesTotal > 0 && e.BytesDone > 0:
+		e.ETASeconds = float64(e.BytesTotal-e.BytesDone) * elapsed / float64(e.BytesDone)
+	case e.BytesTotal == 0 && e.FilesDone > 0:
+		e.ETASeconds = float64(e.FilesTotal-e.FilesDone) * elapsed / float64(e.FilesDone)
+	}
+	if e.ETASeconds < 0 {
+		e.ETASeconds = 0
+	}
+	return e
+}
+
+// startProgress starts to track the progress of the fetch, and logs it every
+// gf.ProgressInterval until the returned func is called. With a
+// gf.ReportWriter, the progress is recorded in rep as well. If listing is
+// set, the files are queued as the manifest is read, until listed is called.
+func (gf *Fetcher) startProgress(rep *Report, listing bool) (stop func()) {
+	gf.progress = nil
+	if gf.ProgressInterval <= 0 {
+		return func() {}
+	}
+	p := newProgress(listing)
+	gf.progress = p
+
+	quit, stopped := make(chan struct{}), make(chan struct{})
+	var events []ProgressEvent
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(gf.ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				e := p.snapshot(now)
+				gf.log("%s", e)
+				events = append(events, e)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+			<-stopped
+			if gf.ReportWriter != nil {
+				rep.Progress = append(rep.Progress, events...)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressSnapshot(t *testing.T) {
+	p := newProgress(true)
+	p.started = time.Now().Add(-10 * time.Second)
+	p.queue(job{bucket: successBucket, object: "a", size: 1000})
+	p.queue(job{bucket: successBucket, object: "b", size: 3000})
+
+	// Sizes are only known once all files are listed.
+	if e := p.snapshot(time.Now()); !e.Listing || e.FilesTotal != 2 || e.ETASeconds != 0 {
+		t.Errorf("snapshot() while listing got %+v, want 2 files listed so far and no ETA", e)
+	}
+	p.listed()
+
+	a := p.start(job{bucket: successBucket, object: "a"})
+	p.finish(a, &jobReport{success: true, size: 1000})
+	p.done(&jobReport{})
+	b := p.start(job{bucket: successBucket, object: "b"})
+	io.Copy(ioutil.Discard, b.reader(bytes.NewReader(make([]byte, 500))))
+	p.retry()
+
+	e := p.snapshot(p.started.Add(10 * time.Second))
+	want := ProgressEvent{
+		Time:                   p.started.Add(10 * time.Second),
+		FilesDone:              1,
+		FilesTotal:             2,
+		BytesDone:              1500,
+		BytesTotal:             4000,
+		MiBPerSecond:           150.0 / 1024 / 1024,
+		ETASeconds:             2500 * 10.0 / 1500,
+		Retries:                1,
+		SlowestInFlight:        formatGCSName(successBucket, "b", 0),
+		SlowestInFlightSeconds: e.SlowestInFlightSeconds,
+	}
+	if e != want {
+		t.Errorf("snapshot() got %+v, want %+v", e, want)
+	}
+
+	// A retry starts over.
+	b.restart()
+	if e := p.snapshot(time.Now()); e.BytesDone != 1000 {
+		t.Errorf("snapshot() after restart() got %d bytes done, want 1000", e.BytesDone)
+	}
+}
+
+func TestProgressEventString(t *testing.T) {
+	e := ProgressEvent{
+		FilesDone:              3,
+		FilesTotal:             10,
+		Listing:                true,
+		BytesDone:              3 << 20,
+		MiBPerSecond:           1.5,
+		ETASeconds:             65,
+		Retries:                2,
+		SlowestInFlight:        "gs://bucket/object",
+		SlowestInFlightSeconds: 42,
+	}
+	want := "Progress: 3/10+ files, 3.0 MiB, 1.50 MiB/s, ETA 1m5s, 2 retries, slowest in flight: gs://bucket/object (42s)"
+	if got := e.String(); got != want {
+		t.Errorf("String() got %q, want %q", got, want)
+	}
+}
+
+// slowGCS delays every read of a fakeGCS object.
+type slowGCS struct {
+	*fakeGCS
+	delay time.Duration
+}
+
+func (f slowGCS) NewReader(ctx context.Context, bucket, object string, gen int64) (io.ReadCloser, error) {
+	time.Sleep(f.delay)
+	return f.fakeGCS.NewReader(ctx, bucket, object, gen)
+}
+
+func TestFetchFromManifestReportsProgress(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	var log, reportJSON bytes.Buffer
+	tc.gf.GCS = slowGCS{fakeGCS: tc.gcs, delay: 100 * time.Millisecond}
+	tc.gf.Stdout = &log
+	tc.gf.ProgressInterval = 20 * time.Millisecond
+	tc.gf.ReportWriter = &reportJSON
+	tc.gf.SourceType = "Manifest"
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() got %v, want nil", err)
+	}
+	if !strings.Contains(log.String(), "Progress: ") {
+		t.Errorf("Fetch() logged %q, want progress lines", log.String())
+	}
+
+	var r Report
+	if err := json.Unmarshal(reportJSON.Bytes(), &r); err != nil {
+		t.Fatalf("json.Unmarshal() got %v, want nil", err)
+	}
+	if len(r.Progress) == 0 {
+		t.Fatalf("Fetch() reported no progress, want some")
+	}
+	for i, e := range r.Progress {
+		if e.FilesDone > e.FilesTotal || (i > 0 && e.FilesDone < r.Progress[i-1].FilesDone) {
+			t.Errorf("Fetch() reported progress %+v, want files done to grow up to the total", r.Progress)
+			break
+		}
+	}
+}
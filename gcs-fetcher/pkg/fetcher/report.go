@@ -0,0 +1,220 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// Report is the machine-readable account of a fetch, which is written as
+// JSON to Fetcher.ReportWriter. Durations are in seconds.
+type Report struct {
+	Status          string    `json:"status"` // SUCCESS, FAILURE or INTERRUPTED.
+	Type            string    `json:"type"`
+	Location        string    `json:"location"`
+	Started         time.Time `json:"started"`
+	Completed       time.Time `json:"completed"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Error           string    `json:"error,omitempty"`
+
+	// Source is the download of the manifest or archive itself.
+	Source *FileReport `json:"source,omitempty"`
+
+	// Files are the downloads of the files listed in a manifest, sorted by
+	// filename.
+	Files []FileReport `json:"files,omitempty"`
+
+	// Progress are the periodic snapshots of the fetch, see
+	// Fetcher.ProgressInterval.
+	Progress []ProgressEvent `json:"progress,omitempty"`
+
+	// Drift is only set for verifications, see Fetcher.Verify.
+	Drift *DriftError `json:"drift,omitempty"`
+
+	Totals ReportTotals `json:"totals"`
+}
+
+// FileReport describes the download of a single file.
+type FileReport struct {
+	Filename        string          `json:"filename"`
+	SourceURL       string          `json:"sourceUrl"`
+	Success         bool            `json:"success"`
+	Started         time.Time       `json:"started"`
+	DurationSeconds float64         `json:"durationSeconds"`
+	SizeBytes       int64           `json:"sizeBytes"`             // Bytes downloaded from GCS.
+	CachedBytes     int64           `json:"cachedBytes,omitempty"` // Bytes taken from the destination or the local cache instead.
+	CopiedBytes     int64           `json:"copiedBytes,omitempty"` // Bytes copied from a duplicate entry instead.
+	Attempts        []AttemptReport `json:"attempts"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// AttemptReport describes a single attempt to download a file.
+type AttemptReport struct {
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	TimeoutSeconds  float64   `json:"timeoutSeconds,omitempty"` // Set if the attempt timed out.
+	Error           string    `json:"error,omitempty"`
+	ErrorClass      string    `json:"errorClass,omitempty"` // transient, throttled or permanent.
+}
+
+// ReportTotals are the aggregate statistics of a fetch.
+type ReportTotals struct {
+	Workers int `json:"workers"`
+	Files   int `json:"files"`
+	Retries int `json:"retries"`
+
+	// Retries by the class of the error that caused them, and files that
+	// failed with a permanent error.
+	TransientRetries  int `json:"transientRetries"`
+	ThrottledRetries  int `json:"throttledRetries"`
+	PermanentFailures int `json:"permanentFailures"`
+
+	GCSTimeouts     int     `json:"gcsTimeouts"`
+	CacheHits       int     `json:"cacheHits"`
+	Duplicates      int     `json:"duplicates"`
+	DownloadedBytes int64   `json:"downloadedBytes"`
+	CachedBytes     int64   `json:"cachedBytes"`
+	LogicalBytes    int64   `json:"logicalBytes"` // Size of all the files, however they were fetched.
+	MiBPerSecond    float64 `json:"mibPerSecond"`
+
+	// WorkerUtilization is the share of the time that the workers were busy
+	// fetching files, and SlowestFiles are the files that took the longest,
+	// slowest first. Both are only set for manifests.
+	WorkerUtilization float64  `json:"workerUtilization,omitempty"`
+	SlowestFiles      []string `json:"slowestFiles,omitempty"`
+
+	// BandwidthWaitSeconds and BucketWaitSeconds are the time that downloads
+	// waited for the bandwidth limit and the per-bucket limit respectively,
+	// summed over all workers.
+	BandwidthWaitSeconds float64 `json:"bandwidthWaitSeconds,omitempty"`
+	BucketWaitSeconds    float64 `json:"bucketWaitSeconds,omitempty"`
+
+	// FilteredFiles are the manifest entries or archive entries that were
+	// not selected by the include and exclude patterns.
+	FilteredFiles int `json:"filteredFiles,omitempty"`
+
+	// ExtractedFiles and ExtractSeconds are only set for archives.
+	ExtractedFiles int     `json:"extractedFiles,omitempty"`
+	ExtractSeconds float64 `json:"extractSeconds,omitempty"`
+
+	// VerifiedFiles are the files whose contents were verified against a
+	// checksum from the manifest; only set for verifications.
+	VerifiedFiles int `json:"verifiedFiles,omitempty"`
+}
+
+// newReport starts the report of the current fetch.
+func (gf *Fetcher) newReport(started time.Time) *Report {
+	gf.report = &Report{
+		Type:     gf.SourceType,
+		Location: formatGCSName(gf.Bucket, gf.Object, gf.Generation),
+		Started:  started,
+	}
+	return gf.report
+}
+
+// writeReport completes the report of the current fetch, which ended with
+// err, and writes it to w.
+func (gf *Fetcher) writeReport(w io.Writer, err error) error {
+	r := gf.report
+	r.Completed = time.Now()
+	r.DurationSeconds = r.Completed.Sub(r.Started).Seconds()
+	r.Status = "SUCCESS"
+	if err != nil {
+		r.Status = "FAILURE"
+		var ierr *InterruptedError
+		if errors.As(err, &ierr) {
+			r.Status = "INTERRUPTED"
+		}
+		r.Error = err.Error()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func newFileReport(report *jobReport) *FileReport {
+	j := report.job
+	fr := &FileReport{
+		Filename:        j.filename,
+		SourceURL:       formatGCSName(j.bucket, j.object, j.generation),
+		Success:         report.success,
+		Started:         report.started,
+		DurationSeconds: report.completed.Sub(report.started).Seconds(),
+		SizeBytes:       int64(report.size),
+		CachedBytes:     int64(report.cached),
+		CopiedBytes:     int64(report.copied),
+		Attempts:        []AttemptReport{},
+	}
+	if report.err != nil {
+		fr.Error = report.err.Error()
+	}
+	for _, a := range report.attempts {
+		ar := AttemptReport{
+			Started:         a.started,
+			DurationSeconds: a.duration.Seconds(),
+		}
+		if a.gcsTimeout > noTimeout {
+			ar.TimeoutSeconds = a.gcsTimeout.Seconds()
+		}
+		if a.err != nil {
+			ar.Error = a.err.Error()
+			ar.ErrorClass = a.class.String()
+		}
+		fr.Attempts = append(fr.Attempts, ar)
+	}
+	return fr
+}
+
+// reportFiles records the downloads of the jobs in stats, and their totals.
+func (r *Report) reportFiles(stats stats) {
+	r.Files = nil
+	for i := range stats.reports {
+		r.Files = append(r.Files, *newFileReport(&stats.reports[i]))
+	}
+	sort.Slice(r.Files, func(a, b int) bool { return r.Files[a].Filename < r.Files[b].Filename })
+
+	r.Totals = ReportTotals{
+		Workers:           stats.workers,
+		Files:             stats.files,
+		Retries:           stats.retries,
+		TransientRetries:  stats.transientRetries,
+		ThrottledRetries:  stats.throttledRetries,
+		PermanentFailures: stats.permanentFailures,
+		GCSTimeouts:       stats.gcsTimeouts,
+		CacheHits:         stats.cacheHits,
+		Duplicates:        stats.duplicates,
+		DownloadedBytes:   int64(stats.size),
+		CachedBytes:       int64(stats.cached),
+		LogicalBytes:      int64(stats.logical),
+	}
+	if stats.duration > 0 {
+		r.Totals.MiBPerSecond = float64(stats.size) / 1024 / 1024 / stats.duration.Seconds()
+	}
+	r.Totals.WorkerUtilization = stats.utilization()
+	for _, report := range stats.slowest(slowestFiles) {
+		r.Totals.SlowestFiles = append(r.Totals.SlowestFiles, report.job.filename)
+	}
+}
+
+// reportLimits records the time that downloads were held back by l.
+func (r *Report) reportLimits(l *limits) {
+	r.Totals.BandwidthWaitSeconds = l.bandwidthWaitTime().Seconds()
+	r.Totals.BucketWaitSeconds = l.bucketWaitTime().Seconds()
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFetchReport(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	manifest := "report-manifest.json"
+	tc.gcs.objects[formatGCSName(successBucket, manifest, generation)] = fakeGCSResponse{content: []byte(`{
+		"sfile1.js": {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"efile2":    {"sourceUrl": "gs://error-bucket/efile2"}
+	}`)}
+	var buf bytes.Buffer
+	tc.gf.Object = manifest
+	tc.gf.SourceType = "Manifest"
+	tc.gf.ReportWriter = &buf
+
+	if err := tc.gf.Fetch(context.Background()); err == nil {
+		t.Fatalf("Fetch() got nil, want error")
+	}
+
+	var r Report
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("Unmarshal(%s) got %v, want nil", buf.Bytes(), err)
+	}
+	if r.Status != "FAILURE" || r.Type != "Manifest" || !strings.Contains(r.Error, "efile2") {
+		t.Errorf("Report got status %q, type %q, error %q, want FAILURE, Manifest and the error of efile2", r.Status, r.Type, r.Error)
+	}
+	if r.Source == nil || !r.Source.Success || r.Source.SizeBytes == 0 {
+		t.Errorf("Report got source %+v, want successful download of the manifest", r.Source)
+	}
+	if len(r.Files) != 2 {
+		t.Fatalf("Report got %d files, want 2", len(r.Files))
+	}
+
+	// Files are sorted by filename.
+	failed, fetched := r.Files[0], r.Files[1]
+	if failed.Filename != "efile2" || failed.Success || len(failed.Attempts) != maxretries+1 || failed.Error == "" {
+		t.Errorf("Report got %+v, want failure after %d attempts", failed, maxretries+1)
+	}
+	for _, a := range failed.Attempts {
+		if a.Error == "" {
+			t.Errorf("Report got attempt %+v for efile2, want error", a)
+		}
+	}
+	if fetched.Filename != sfile1 || !fetched.Success || fetched.SizeBytes != int64(len(sfile1Contents)) || len(fetched.Attempts) != 1 {
+		t.Errorf("Report got %+v, want success on first attempt", fetched)
+	}
+	if want := (ReportTotals{Files: 2, Retries: maxretries, DownloadedBytes: int64(len(sfile1Contents)), LogicalBytes: int64(len(sfile1Contents))}); r.Totals.Files != want.Files || r.Totals.Retries != want.Retries || r.Totals.DownloadedBytes != want.DownloadedBytes || r.Totals.LogicalBytes != want.LogicalBytes {
+		t.Errorf("Report got totals %+v, want %+v", r.Totals, want)
+	}
+}
+
+func TestFetchReportMisconfigured(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	var buf bytes.Buffer
+	tc.gf.SourceType = "Bogus"
+	tc.gf.ReportWriter = &buf
+	if err := tc.gf.Fetch(context.Background()); err == nil {
+		t.Fatalf("Fetch() got nil, want error")
+	}
+
+	var r Report
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("Unmarshal(%s) got %v, want nil", buf.Bytes(), err)
+	}
+	if r.Status != "FAILURE" || !strings.Contains(r.Error, "Bogus") {
+		t.Errorf("Report got status %q, error %q, want FAILURE for type Bogus", r.Status, r.Error)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// resumable reports whether a failed download of job j can be resumed from
+// the bytes it wrote so far. It can if the download is pinned to a
+// generation of known size, so that the resumed bytes belong to the same
+// version of the object, and the backend supports ranged reads.
+func (gf *Fetcher) resumable(j job) bool {
+	if j.sliceOf != "" || j.generation == 0 || j.size <= 0 {
+		return false
+	}
+	g, err := gf.backend(j.bucket)
+	if err != nil {
+		return false
+	}
+	_, ok := g.(RangeGCS)
+	return ok
+}
+
+// keepPartial returns the number of bytes in the partial temp file dest of
+// a resumed download of job j that the attempt failed before it wrote to, so
+// that the next attempt resumes the download at the same offset. Once the
+// attempt timed out, no one waits for its result anymore, so the file is
+// removed instead.
+func (gf *Fetcher) keepPartial(j job, dest string, breakerSig <-chan struct{}) int64 {
+	if j.resumeFrom == 0 {
+		return 0
+	}
+	select {
+	case <-breakerSig:
+		gf.OS.RemoveAll(dest)
+		return 0
+	default:
+		return j.resumeFrom
+	}
+}
+
+// openResumed opens the partial temp file dest of a failed download of job
+// j, to resume the download at j.resumeFrom. The bytes already in dest are
+// added to sums, so that the whole file is verified. Bytes beyond
+// j.resumeFrom, if any, are discarded.
+func (gf *Fetcher) openResumed(j job, dest string, sums io.Writer) (*os.File, io.Writer, error) {
+	f, err := gf.OS.OpenFile(dest, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := f.Truncate(j.resumeFrom); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if n, err := io.Copy(sums, io.NewSectionReader(f, 0, j.resumeFrom)); err != nil || n != j.resumeFrom {
+		f.Close()
+		if err == nil {
+			err = fmt.Errorf("read %d bytes, want %d", n, j.resumeFrom)
+		}
+		return nil, nil, fmt.Errorf("reading partial file: %w", err)
+	}
+	return f, io.NewOffsetWriter(f, j.resumeFrom), nil
+}
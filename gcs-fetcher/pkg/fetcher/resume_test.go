@@ -0,0 +1,260 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// brokenGCS adds ranged reads to fakeRangeGCS, whose full reads fail after
+// the first failAfter bytes. The first rangeErrs ranged reads fail with 503.
+type brokenGCS struct {
+	*fakeRangeGCS
+	failAfter int
+	rangeErrs int
+}
+
+func (f *brokenGCS) NewReader(ctx context.Context, bucket, object string, gen int64) (io.ReadCloser, error) {
+	content := f.objects[formatGCSName(bucket, object, generation)].content
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(content[:f.failAfter]), fakeGCSErrorReader{err: errGCSRead})), nil
+}
+
+func (f *brokenGCS) NewRangeReader(ctx context.Context, bucket, object string, gen, offset, length int64) (io.ReadCloser, error) {
+	f.mu.Lock()
+	fail := f.rangeErrs > 0
+	if fail {
+		f.rangeErrs--
+		f.ranges = append(f.ranges, offset)
+	}
+	f.mu.Unlock()
+	if fail {
+		return nil, &googleapi.Error{Code: http.StatusServiceUnavailable}
+	}
+	return f.fakeRangeGCS.NewRangeReader(ctx, bucket, object, gen, offset, length)
+}
+
+// stalledGCS adds ranged reads to fakeRangeGCS, whose full reads stall after
+// the first stallAfter bytes until they are cancelled.
+type stalledGCS struct {
+	*fakeRangeGCS
+	stallAfter int
+}
+
+func (f *stalledGCS) NewReader(ctx context.Context, bucket, object string, gen int64) (io.ReadCloser, error) {
+	content := f.objects[formatGCSName(bucket, object, generation)].content
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(content[:f.stallAfter]), stalledReader{ctx})), nil
+}
+
+type stalledReader struct {
+	ctx context.Context
+}
+
+func (r stalledReader) Read(p []byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+// stagedFiles returns the files left in the staging dir of gf.
+func stagedFiles(t *testing.T, gf *Fetcher) []string {
+	t.Helper()
+	var files []string
+	filepath.Walk(gf.StagingDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files
+}
+
+func TestFetchObjectResumes(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	g := &brokenGCS{fakeRangeGCS: &fakeRangeGCS{fakeGCS: tc.gcs, failOffset: -1}, failAfter: 5}
+	tc.gf.GCS = g
+	j := job{filename: "resumed", bucket: successBucket, object: sfile1}
+	report := tc.gf.fetchObject(context.Background(), j)
+	if !report.success {
+		t.Fatalf("fetchObject() got %v, want success", report.err)
+	}
+	if len(g.ranges) != 1 || g.ranges[0] != int64(g.failAfter) {
+		t.Errorf("fetchObject() read ranges at %v, want [%d]", g.ranges, g.failAfter)
+	}
+	if report.size != sizeBytes(len(sfile1Contents)) {
+		t.Errorf("fetchObject() got size %d, want %d", report.size, len(sfile1Contents))
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "resumed"))
+	if err != nil || !bytes.Equal(got, sfile1Contents) {
+		t.Errorf("fetchObject() wrote %q (%v), want %q", got, err, sfile1Contents)
+	}
+	if files := stagedFiles(t, tc.gf); len(files) != 0 {
+		t.Errorf("fetchObject() left %v in the staging dir, want none", files)
+	}
+}
+
+func TestFetchObjectResumeVerifiesWholeFile(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	g := &brokenGCS{fakeRangeGCS: &fakeRangeGCS{fakeGCS: tc.gcs, failOffset: -1, badCRC: true}, failAfter: 5}
+	tc.gf.GCS = g
+	tc.gf.Retries = 1
+	j := job{filename: "resumed", bucket: successBucket, object: sfile1}
+	report := tc.gf.fetchObject(context.Background(), j)
+	var cerr *ChecksumError
+	if report.success || !errors.As(report.err, &cerr) {
+		t.Errorf("fetchObject() got %v, want ChecksumError", report.err)
+	}
+	if len(g.ranges) != 1 {
+		t.Errorf("fetchObject() read ranges at %v, want the resumed one", g.ranges)
+	}
+	if files := stagedFiles(t, tc.gf); len(files) != 0 {
+		t.Errorf("fetchObject() left %v in the staging dir, want none", files)
+	}
+}
+
+func TestFetchObjectRestartsWithoutGeneration(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	// Without attributes, the generation of the partial file is unknown.
+	tc.gcs.objects[formatGCSName(errorBucket, "partial", generation)] = fakeGCSResponse{err: errGCSRead}
+	tc.gf.Retries = 1
+	j := job{filename: "partial", bucket: errorBucket, object: "partial"}
+	report := tc.gf.fetchObject(context.Background(), j)
+	if report.success || len(report.attempts) != 2 {
+		t.Fatalf("fetchObject() got %d attempts (%v), want 2 failed ones", len(report.attempts), report.err)
+	}
+	if files := stagedFiles(t, tc.gf); len(files) != 0 {
+		t.Errorf("fetchObject() left %v in the staging dir, want none", files)
+	}
+}
+
+func TestFetchObjectResumesAfterUnavailable(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	g := &brokenGCS{fakeRangeGCS: &fakeRangeGCS{fakeGCS: tc.gcs, failOffset: -1}, failAfter: 5, rangeErrs: 1}
+	tc.gf.GCS = g
+	tc.gf.MaxBackoff = time.Millisecond
+	j := job{filename: "resumed", bucket: successBucket, object: sfile1}
+	report := tc.gf.fetchObject(context.Background(), j)
+	if !report.success {
+		t.Fatalf("fetchObject() got %v, want success", report.err)
+	}
+	// The offset outlives the attempt that failed to open the rest.
+	if len(g.ranges) != 2 || g.ranges[0] != int64(g.failAfter) || g.ranges[1] != int64(g.failAfter) {
+		t.Errorf("fetchObject() read ranges at %v, want [%d %d]", g.ranges, g.failAfter, g.failAfter)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "resumed"))
+	if err != nil || !bytes.Equal(got, sfile1Contents) {
+		t.Errorf("fetchObject() wrote %q (%v), want %q", got, err, sfile1Contents)
+	}
+	if files := stagedFiles(t, tc.gf); len(files) != 0 {
+		t.Errorf("fetchObject() left %v in the staging dir, want none", files)
+	}
+}
+
+func TestFetchObjectRemovesPartialFile(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	g := &brokenGCS{fakeRangeGCS: &fakeRangeGCS{fakeGCS: tc.gcs, failOffset: -1}, failAfter: 5, rangeErrs: 10}
+	tc.gf.GCS = g
+	tc.gf.MaxBackoff = time.Millisecond
+	tc.gf.Retries = 2
+	j := job{filename: "resumed", bucket: successBucket, object: sfile1}
+	if report := tc.gf.fetchObject(context.Background(), j); report.success {
+		t.Fatalf("fetchObject() got success, want the resumed reads to fail it")
+	}
+	if len(g.ranges) != 2 {
+		t.Errorf("fetchObject() read ranges at %v, want 2 resumed reads", g.ranges)
+	}
+	if files := stagedFiles(t, tc.gf); len(files) != 0 {
+		t.Errorf("fetchObject() left %v in the staging dir, want none", files)
+	}
+}
+
+func TestFetchFromArchiveResumes(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	// With the default flags, archives are neither streamed nor sliced.
+	object := "source.tar.gz"
+	tc.gcs.objects[formatGCSName(successBucket, object, generation)] = fakeGCSResponse{content: buildArchive(t, "TarGzArchive")}
+	g := &brokenGCS{fakeRangeGCS: &fakeRangeGCS{fakeGCS: tc.gcs, failOffset: -1}, failAfter: 10}
+	tc.gf.GCS = g
+	tc.gf.Object = object
+	tc.gf.SourceType = "Auto"
+	tc.gf.Stream = false
+	tc.gf.SliceThreshold = 0
+
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() got %v, want nil", err)
+	}
+	if len(g.ranges) != 1 || g.ranges[0] != int64(g.failAfter) {
+		t.Errorf("Fetch() read ranges at %v, want [%d]", g.ranges, g.failAfter)
+	}
+	name := filepath.Join(tc.gf.DestDir, "dir/file.txt")
+	if b, err := ioutil.ReadFile(name); err != nil || string(b) != archivedContent {
+		t.Errorf("ReadFile(%s) got (%q, %v), want (%q, nil)", name, b, err, archivedContent)
+	}
+	if files := stagedFiles(t, tc.gf); len(files) != 0 {
+		t.Errorf("Fetch() left %v in the staging dir, want none", files)
+	}
+}
+
+func TestFetchObjectResumesAfterTimeout(t *testing.T) {
+	defer func(timeouts map[int]time.Duration) { latencyTimeout = timeouts }(latencyTimeout)
+	latencyTimeout = map[int]time.Duration{0: 50 * time.Millisecond, 1: 50 * time.Millisecond}
+
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	g := &stalledGCS{fakeRangeGCS: &fakeRangeGCS{fakeGCS: tc.gcs, failOffset: -1}, stallAfter: 5}
+	tc.gf.GCS = g
+	tc.gf.TimeoutGCS = true
+	j := job{filename: "resumed", bucket: successBucket, object: sfile1}
+	report := tc.gf.fetchObject(context.Background(), j)
+	if !report.success {
+		t.Fatalf("fetchObject() got %v, want success", report.err)
+	}
+	if len(report.attempts) != 2 || !errors.Is(report.attempts[0].err, errGCSTimeout) {
+		t.Errorf("fetchObject() got attempts %+v, want a timeout and a success", report.attempts)
+	}
+	if len(g.ranges) != 1 || g.ranges[0] != int64(g.stallAfter) {
+		t.Errorf("fetchObject() read ranges at %v, want [%d]", g.ranges, g.stallAfter)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "resumed"))
+	if err != nil || !bytes.Equal(got, sfile1Contents) {
+		t.Errorf("fetchObject() wrote %q (%v), want %q", got, err, sfile1Contents)
+	}
+	if files := stagedFiles(t, tc.gf); len(files) != 0 {
+		t.Errorf("fetchObject() left %v in the staging dir, want none", files)
+	}
+}
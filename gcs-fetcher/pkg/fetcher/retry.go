@@ -0,0 +1,140 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// minThrottledBackoff is the smallest backoff range after GCS throttled a
+// download, however small Fetcher.Backoff is.
+var minThrottledBackoff = 1 * time.Second
+
+// errorClass tells how a failed attempt to download a file is retried.
+type errorClass int
+
+const (
+	// transientError is retried with exponential backoff.
+	transientError errorClass = iota
+	// throttledError is retried with full-jitter exponential backoff, so
+	// that workers throttled at the same time do not retry in lockstep.
+	throttledError
+	// permanentError is not retried, as the next attempt would fail the
+	// same way.
+	permanentError
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case throttledError:
+		return "throttled"
+	case permanentError:
+		return "permanent"
+	default:
+		return "transient"
+	}
+}
+
+// classify returns the class of err, the error of a failed attempt.
+func classify(err error) errorClass {
+	var (
+		perr *PermissionError
+		nerr *NotFoundError
+		oerr *UserProjectError
+		kerr *EncryptionKeyError
+		uerr *UnverifiableError
+		cerr *ChecksumError
+	)
+	code, hasStatus := httpStatus(err)
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// The fetch was interrupted; attempts to time out GCS reads are
+		// reported as errGCSTimeout instead.
+		return permanentError
+	case errors.As(err, &perr), errors.As(err, &nerr), errors.As(err, &uerr), errors.Is(err, errNoGenerations):
+		return permanentError
+	case errors.As(err, &oerr), errors.As(err, &kerr):
+		return permanentError
+	case errors.As(err, &cerr):
+		// A pinned generation never changes, so neither does its checksum.
+		// Without a generation, the object may have been replaced mid-read.
+		if cerr.Generation > 0 {
+			return permanentError
+		}
+		return transientError
+	case hasStatus:
+		// The status of a GCS error or of a response from another backend.
+		switch code {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return throttledError
+		case http.StatusRequestTimeout:
+			return transientError
+		}
+		if code >= 400 && code < 500 {
+			return permanentError
+		}
+		return transientError
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, syscall.EROFS):
+		// The local disk will not free itself up in time for a retry.
+		return permanentError
+	}
+	return transientError
+}
+
+// retryable reports whether job j should be retried after an attempt that
+// failed with an error of class c.
+func retryable(j job, c errorClass) bool {
+	return c != permanentError || j.awaitVisible
+}
+
+// retryBackoff returns the time to wait before retry number retrynum, after
+// an attempt that failed with an error of class c. The backoff doubles with
+// every retry, up to gf.MaxBackoff. Throttled attempts wait a random time up
+// to that backoff instead.
+func (gf *Fetcher) retryBackoff(retrynum int, c errorClass) time.Duration {
+	backoff := gf.Backoff
+	if c == throttledError && backoff < minThrottledBackoff {
+		backoff = minThrottledBackoff
+	}
+	for i := 1; i < retrynum; i++ {
+		backoff *= 2
+		if gf.MaxBackoff > 0 && backoff >= gf.MaxBackoff {
+			break
+		}
+	}
+	if gf.MaxBackoff > 0 && backoff > gf.MaxBackoff {
+		backoff = gf.MaxBackoff
+	}
+	if c == throttledError {
+		backoff = time.Duration(rand.Int63n(int64(backoff) + 1))
+	}
+	return backoff
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassify(t *testing.T) {
+	info := JobInfo{Bucket: successBucket, Object: sfile1}
+	pinned := JobInfo{Bucket: successBucket, Object: sfile1, Generation: generation}
+	for _, c := range []struct {
+		err  error
+		want errorClass
+	}{
+		{errNonNil, transientError},
+		{errGCSTimeout, transientError},
+		{fmt.Errorf("fetching: %w", errGCSTimeout), transientError},
+		{&PermissionError{JobInfo: info}, permanentError},
+		{fmt.Errorf("fetching: %w", &NotFoundError{JobInfo: pinned}), permanentError},
+		{&ChecksumError{JobInfo: info}, transientError},
+		{&ChecksumError{JobInfo: pinned}, permanentError},
+		{&googleapi.Error{Code: 429}, throttledError},
+		{fmt.Errorf("creating GCS reader: %w", &googleapi.Error{Code: 503}), throttledError},
+		{&googleapi.Error{Code: 500}, transientError},
+		{&googleapi.Error{Code: 408}, transientError},
+		{&googleapi.Error{Code: 400}, permanentError},
+		{&statusError{method: "GET", url: "https://example.com/f", code: 503}, throttledError},
+		{fmt.Errorf("creating reader: %w", &statusError{method: "GET", url: "https://example.com/f", code: 404}), permanentError},
+		{&statusError{method: "GET", url: "https://example.com/f", code: 502}, transientError},
+		{errNoGenerations, permanentError},
+		{&UserProjectError{JobInfo: info}, permanentError},
+		{fmt.Errorf("fetching: %w", &EncryptionKeyError{JobInfo: info}), permanentError},
+		{fmt.Errorf("copying bytes: %w", &os.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC}), permanentError},
+		{&os.PathError{Op: "open", Path: "f", Err: syscall.EROFS}, permanentError},
+		{&os.PathError{Op: "open", Path: "f", Err: syscall.ENOENT}, transientError},
+		{context.Canceled, permanentError},
+		{fmt.Errorf("fetching: %w", context.DeadlineExceeded), permanentError},
+	} {
+		if got := classify(c.err); got != c.want {
+			t.Errorf("classify(%v) got %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(d time.Duration) { minThrottledBackoff = d }(minThrottledBackoff)
+	minThrottledBackoff = 400 * time.Millisecond
+
+	gf := &Fetcher{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for _, c := range []struct {
+		retrynum int
+		want     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	} {
+		if got := gf.retryBackoff(c.retrynum, transientError); got != c.want {
+			t.Errorf("retryBackoff(%d, transient) got %v, want %v", c.retrynum, got, c.want)
+		}
+	}
+
+	// Throttled retries start from minThrottledBackoff, and are spread out
+	// up to the backoff.
+	for _, c := range []struct {
+		retrynum int
+		max      time.Duration
+	}{
+		{1, 400 * time.Millisecond},
+		{2, 800 * time.Millisecond},
+		{3, time.Second},
+	} {
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			got := gf.retryBackoff(c.retrynum, throttledError)
+			if got < 0 || got > c.max {
+				t.Errorf("retryBackoff(%d, throttled) got %v, want at most %v", c.retrynum, got, c.max)
+			}
+			seen[got] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("retryBackoff(%d, throttled) got %v in 100 calls, want jitter", c.retrynum, seen)
+		}
+	}
+}
+
+func TestFetchObjectFailsFastOnPermanentError(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	// The fake serves no other generation than generation.
+	j := job{filename: sfile1, bucket: successBucket, object: sfile1, generation: generation + 1}
+	report := tc.gf.fetchObject(context.Background(), j)
+	if report.success || len(report.attempts) != 1 {
+		t.Errorf("fetchObject() got success %v after %d attempts, want failure after 1", report.success, len(report.attempts))
+	}
+
+	// Objects that may not be visible yet are retried regardless.
+	j.awaitVisible = true
+	report = tc.gf.fetchObject(context.Background(), j)
+	if report.success || len(report.attempts) != maxretries+1 {
+		t.Errorf("fetchObject() awaiting visibility got success %v after %d attempts, want failure after %d", report.success, len(report.attempts), maxretries+1)
+	}
+}
+
+// throttlingGCS fails the first read of every object with a 429.
+type throttlingGCS struct {
+	GCS
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (f *throttlingGCS) NewReader(ctx context.Context, bucket, object string, generation int64) (io.ReadCloser, error) {
+	f.mu.Lock()
+	throttle := !f.seen[object]
+	f.seen[object] = true
+	f.mu.Unlock()
+	if throttle {
+		return nil, &googleapi.Error{Code: 429, Message: "rate limit exceeded"}
+	}
+	return f.GCS.NewReader(ctx, bucket, object, generation)
+}
+
+func TestProcessJobsCountsRetriesByClass(t *testing.T) {
+	defer func(d time.Duration) { minThrottledBackoff = d }(minThrottledBackoff)
+	minThrottledBackoff = time.Millisecond
+
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+	tc.gf.GCS = &throttlingGCS{GCS: tc.gcs, seen: map[string]bool{}}
+
+	jobs := []job{
+		{filename: sfile1, bucket: successBucket, object: sfile1},
+		{filename: sfile2, bucket: successBucket, object: sfile2},
+		{filename: "missing", bucket: successBucket, object: sfile3, generation: generation + 1},
+	}
+	stats := tc.gf.processJobs(context.Background(), jobs)
+	// The missing file is throttled once, then fails for good.
+	if stats.throttledRetries != 3 || stats.transientRetries != 0 || stats.permanentFailures != 1 {
+		t.Errorf("processJobs() got %d throttled and %d transient retries and %d permanent failures, want 3, 0 and 1", stats.throttledRetries, stats.transientRetries, stats.permanentFailures)
+	}
+}
+
+// failingGCS fails every read with err.
+type failingGCS struct {
+	GCS
+	err error
+}
+
+func (f failingGCS) NewReader(ctx context.Context, bucket, object string, generation int64) (io.ReadCloser, error) {
+	return nil, f.err
+}
+
+func TestFetchObjectExplainsMissingOptions(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	for _, c := range []struct {
+		err   error
+		check func(error) bool
+	}{{
+		err: &googleapi.Error{Code: 400, Body: "<Error><Code>UserProjectMissing</Code></Error>"},
+		check: func(err error) bool {
+			var oerr *UserProjectError
+			return errors.As(err, &oerr) && strings.Contains(err.Error(), "--billing_project")
+		},
+	}, {
+		err: &googleapi.Error{Code: 400, Message: "The target object is encrypted by a customer-supplied encryption key."},
+		check: func(err error) bool {
+			var kerr *EncryptionKeyError
+			return errors.As(err, &kerr) && !kerr.Incorrect && strings.Contains(err.Error(), "--encryption_key_file")
+		},
+	}, {
+		err: &googleapi.Error{Code: 400, Message: "The provided encryption key is incorrect."},
+		check: func(err error) bool {
+			var kerr *EncryptionKeyError
+			return errors.As(err, &kerr) && kerr.Incorrect
+		},
+	}} {
+		tc.gf.GCS = failingGCS{GCS: tc.gcs, err: c.err}
+		j := job{filename: sfile1, bucket: successBucket, object: sfile1}
+		report := tc.gf.fetchObject(context.Background(), j)
+		if !c.check(report.err) || len(report.attempts) != 1 {
+			t.Errorf("fetchObject() failing with %v got %v after %d attempts, want an explanation after 1", c.err, report.err, len(report.attempts))
+		}
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the SHA256 checksum of the empty payload of GET and HEAD
+// requests.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Backend serves the objects of s3:// URLs from Amazon S3 or another
+// S3-compatible endpoint, using path-style requests signed with AWS Signature
+// Version 4. Without an AccessKeyID, requests are sent unsigned, which only
+// works for public buckets.
+type S3Backend struct {
+	// Client makes the requests; nil means http.DefaultClient.
+	Client *http.Client
+
+	// Endpoint is the base URL of the S3 API, e.g.
+	// https://s3.us-east-1.amazonaws.com, and Region the region that
+	// requests are signed for, e.g. us-east-1.
+	Endpoint, Region string
+
+	AccessKeyID, SecretAccessKey string
+	SessionToken                 string // Only set for temporary credentials.
+
+	// now is the time that requests are signed at; nil means time.Now.
+	now func() time.Time
+}
+
+// newRequest returns a request for the object in the bucket, as named by
+// common.ParseSourceURL.
+func (sb *S3Backend) newRequest(ctx context.Context, method, bucket, object string) (*http.Request, error) {
+	u := strings.TrimSuffix(sb.Endpoint, "/") + "/" + s3Escape(strings.TrimPrefix(bucket, "s3://"), false) + "/" + s3Escape(object, true)
+	return http.NewRequestWithContext(ctx, method, u, nil)
+}
+
+// NewReader returns a reader for the object.
+func (sb *S3Backend) NewReader(ctx context.Context, bucket, object string, generation int64) (io.ReadCloser, error) {
+	return sb.NewRangeReader(ctx, bucket, object, generation, 0, -1)
+}
+
+// NewRangeReader returns a reader for length bytes of the object, starting at
+// offset; a negative length reads to the end of the object.
+func (sb *S3Backend) NewRangeReader(ctx context.Context, bucket, object string, generation, offset, length int64) (io.ReadCloser, error) {
+	if generation != 0 {
+		return nil, errNoGenerations
+	}
+	req, err := sb.newRequest(ctx, http.MethodGet, bucket, object)
+	if err != nil {
+		return nil, err
+	}
+	return getRange(sb.Client, req, sb.sign, offset, length)
+}
+
+// Attrs returns the size of the object, and its CRC32C checksum if one was
+// recorded when it was uploaded. ETags are not used as MD5 checksums, as
+// they are not for multipart uploads and encrypted objects.
+func (sb *S3Backend) Attrs(ctx context.Context, bucket, object string, generation int64) (*ObjectAttrs, error) {
+	if generation != 0 {
+		return nil, errNoGenerations
+	}
+	req, err := sb.newRequest(ctx, http.MethodHead, bucket, object)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	resp, err := do(sb.Client, req, sb.sign, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	attrs, err := httpAttrs(resp)
+	if err != nil {
+		return nil, err
+	}
+	if crc, ok := decodeCRC32C(resp.Header.Get("X-Amz-Checksum-Crc32c")); ok {
+		attrs.CRC32C, attrs.NoCRC32C = crc, false
+	}
+	return attrs, nil
+}
+
+// sign signs req, which has no payload, with AWS Signature Version 4. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html.
+func (sb *S3Backend) sign(req *http.Request) {
+	if sb.AccessKeyID == "" {
+		return
+	}
+	now := time.Now
+	if sb.now != nil {
+		now = sb.now
+	}
+	t := now().UTC()
+	amzDate, date := t.Format("20060102T150405Z"), t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if sb.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sb.SessionToken)
+	}
+
+	// All headers set so far are signed, along with the host.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, strings.TrimSpace(headers[k]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	scope := date + "/" + sb.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + sb.SecretAccessKey)
+	for _, s := range []string{date, sb.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", sb.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns the query of req with its parameters sorted and
+// escaped as Signature Version 4 requires.
+func canonicalQuery(req *http.Request) string {
+	q := req.URL.Query()
+	var params []string
+	for k, vs := range q {
+		for _, v := range vs {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent-encodes every byte of s but the unreserved characters,
+// and slashes if keepSlash is set.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// scheduleWindow is the number of jobs per worker that the scheduler looks
+// ahead in a stream of jobs to pick the largest from. It bounds the memory
+// that a large manifest takes while it is decoded faster than its files can
+// be fetched.
+const scheduleWindow = 64
+
+// slowestFiles is the number of slowest files listed in the final summary.
+const slowestFiles = 3
+
+// jobQueue holds jobs in the order in which they are fetched: largest
+// first, so that the largest files do not start last and dominate the total
+// fetch time, while the smaller files keep the other workers busy. Files of
+// unknown size come last.
+type jobQueue []job
+
+func (q jobQueue) Len() int            { return len(q) }
+func (q jobQueue) Less(a, b int) bool  { return q[a].size > q[b].size }
+func (q jobQueue) Swap(a, b int)       { q[a], q[b] = q[b], q[a] }
+func (q *jobQueue) Push(x interface{}) { *q = append(*q, x.(job)) }
+func (q *jobQueue) Pop() interface{} {
+	old := *q
+	j := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return j
+}
+
+// slowestQueue holds the reports of the slowest files fetched so far, up to
+// slowestFiles of them, fastest first so that it is the one replaced.
+type slowestQueue []jobReport
+
+func (q slowestQueue) Len() int            { return len(q) }
+func (q slowestQueue) Less(a, b int) bool  { return elapsed(q[a]) < elapsed(q[b]) }
+func (q slowestQueue) Swap(a, b int)       { q[a], q[b] = q[b], q[a] }
+func (q *slowestQueue) Push(x interface{}) { *q = append(*q, x.(jobReport)) }
+func (q *slowestQueue) Pop() interface{} {
+	old := *q
+	r := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return r
+}
+
+// add adds report to q, dropping the fastest report if q is full.
+func (q *slowestQueue) add(report jobReport) {
+	heap.Push(q, report)
+	if q.Len() > slowestFiles {
+		heap.Pop(q)
+	}
+}
+
+func elapsed(report jobReport) time.Duration {
+	return report.completed.Sub(report.started)
+}
+
+// schedule sends the jobs received from in to out until in is closed,
+// always sending the largest of the jobs received so far but not sent yet,
+// and looking ahead at most window jobs. Once done is closed, the jobs not
+// sent yet are dropped, and the remaining jobs from in are drained. started
+// is called for every job received. schedule returns the number of jobs
+// that were dropped.
+func schedule(in <-chan job, out chan<- job, window int, done <-chan struct{}, started func()) (dropped int) {
+	var pending jobQueue
+	for in != nil || len(pending) > 0 {
+		select {
+		case <-done:
+			dropped += len(pending)
+			if in != nil {
+				for range in {
+					dropped++
+				}
+			}
+			return dropped
+		default:
+		}
+
+		// Only receive more jobs while the window has room, and only send
+		// if there is a job to send.
+		recv, send := in, out
+		if len(pending) >= window {
+			recv = nil
+		}
+		var next job
+		if len(pending) > 0 {
+			next = pending[0]
+		} else {
+			send = nil
+		}
+		select {
+		case j, ok := <-recv:
+			if !ok {
+				in = nil
+				continue
+			}
+			started()
+			heap.Push(&pending, j)
+		case send <- next:
+			heap.Pop(&pending)
+		case <-done:
+		}
+	}
+	return dropped
+}
+
+// utilization returns the share of the time that the workers of stats were
+// busy fetching files.
+func (s stats) utilization() float64 {
+	if s.workers == 0 || s.duration <= 0 {
+		return 0
+	}
+	return float64(s.busy) / float64(time.Duration(s.workers)*s.duration)
+}
+
+// slowest returns the reports of the n files of stats that took the
+// longest, slowest first, up to slowestFiles of them.
+func (s stats) slowest(n int) []jobReport {
+	reports := append([]jobReport(nil), s.slowestReports...)
+	sort.SliceStable(reports, func(a, b int) bool {
+		return elapsed(reports[a]) > elapsed(reports[b])
+	})
+	if len(reports) > n {
+		reports = reports[:n]
+	}
+	return reports
+}
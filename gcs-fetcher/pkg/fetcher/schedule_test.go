@@ -0,0 +1,138 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startSchedule schedules jobs of the given sizes with window, and waits
+// until want of them have been received before it returns the scheduled
+// jobs.
+func startSchedule(sizes []int64, window, want int, done chan struct{}) (<-chan job, <-chan int) {
+	in := make(chan job, len(sizes))
+	for i, size := range sizes {
+		in <- job{filename: string(rune('a' + i)), size: size}
+	}
+	close(in)
+	out := make(chan job)
+	received := make(chan struct{}, len(sizes))
+	dropped := make(chan int, 1)
+	go func() {
+		dropped <- schedule(in, out, window, done, func() { received <- struct{}{} })
+		close(out)
+	}()
+	for i := 0; i < want; i++ {
+		<-received
+	}
+	return out, dropped
+}
+
+func TestSchedule(t *testing.T) {
+	out, dropped := startSchedule([]int64{1, 5, 0, 3}, 10, 4, nil)
+	var got []int64
+	for j := range out {
+		got = append(got, j.size)
+	}
+	if want := []int64{5, 3, 1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("schedule() got sizes %v, want %v", got, want)
+	}
+	if got := <-dropped; got != 0 {
+		t.Errorf("schedule() dropped %d jobs, want 0", got)
+	}
+}
+
+func TestScheduleWindow(t *testing.T) {
+	out, _ := startSchedule([]int64{1, 2, 3, 4}, 2, 2, nil)
+	if got := <-out; got.size != 2 {
+		t.Errorf("schedule() got size %d first, want 2 with a window of 2 jobs", got.size)
+	}
+	n := 1
+	for range out {
+		n++
+	}
+	if n != 4 {
+		t.Errorf("schedule() got %d jobs, want 4", n)
+	}
+}
+
+func TestScheduleDone(t *testing.T) {
+	done := make(chan struct{})
+	out, dropped := startSchedule([]int64{1, 2, 3}, 1, 1, done)
+	close(done)
+	if got := <-dropped; got != 3 {
+		t.Errorf("schedule() dropped %d jobs, want 3", got)
+	}
+	if _, ok := <-out; ok {
+		t.Errorf("schedule() sent a job after done was closed, want none")
+	}
+}
+
+func TestProcessJobsLargestFirst(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	tc.gf.WorkerCount = 1
+	tc.gf.ReportWriter = ioutil.Discard
+	jobs := []job{
+		{filename: "small", bucket: successBucket, object: sfile1, size: int64(len(sfile1Contents))},
+		{filename: "large", bucket: successBucket, object: sfile3, size: int64(len(sfile3Contents))},
+		{filename: "unknown", bucket: successBucket, object: sfile2},
+	}
+	stats := tc.gf.processJobs(context.Background(), jobs)
+	var got []string
+	for _, report := range stats.reports {
+		got = append(got, report.job.filename)
+	}
+	if want := []string{"large", "small", "unknown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("processJobs() fetched %v, want %v", got, want)
+	}
+	if u := stats.utilization(); u <= 0 || u > 1 {
+		t.Errorf("processJobs() utilization got %v, want within (0, 1]", u)
+	}
+}
+
+func TestStatsUtilizationAndSlowest(t *testing.T) {
+	start := time.Now()
+	report := func(name string, d time.Duration) jobReport {
+		return jobReport{job: job{filename: name}, started: start, completed: start.Add(d)}
+	}
+	s := stats{
+		workers:  2,
+		duration: 10 * time.Second,
+		busy:     15 * time.Second,
+	}
+	for _, r := range []jobReport{report("a", time.Second), report("b", 3*time.Second), report("c", 2*time.Second), report("d", time.Second/2)} {
+		s.slowestReports.add(r)
+	}
+	if got, want := s.utilization(), 0.75; got != want {
+		t.Errorf("utilization() got %v, want %v", got, want)
+	}
+	var got []string
+	if got := s.slowestReports.Len(); got != slowestFiles {
+		t.Errorf("slowestReports got %d reports, want %d", got, slowestFiles)
+	}
+	for _, r := range s.slowest(2) {
+		got = append(got, r.job.filename)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("slowest(2) got %v, want %v", got, want)
+	}
+}
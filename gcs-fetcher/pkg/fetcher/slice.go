@@ -0,0 +1,255 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// minSliceSize is the smallest slice a sliced download is split into.
+var minSliceSize int64 = 8 << 20
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ObjectAttrs are the attributes of a GCS object that downloads rely on.
+type ObjectAttrs struct {
+	Size       int64
+	Generation int64
+	CRC32C     uint32 // CRC32C checksum of the object, using the Castagnoli polynomial.
+	MD5        []byte // MD5 checksum of the object; empty for composite objects.
+
+	// NoCRC32C is set by backends that do not know the CRC32C checksum of
+	// the object, in which case CRC32C is ignored.
+	NoCRC32C bool
+}
+
+// AttrsGCS is a GCS that can also return the attributes of objects, which
+// allows downloads to be verified against their checksums.
+type AttrsGCS interface {
+	GCS
+
+	// Attrs returns the attributes of the object. If generation is non-zero,
+	// they must be the attributes of exactly that generation.
+	Attrs(ctx context.Context, bucket, object string, generation int64) (*ObjectAttrs, error)
+}
+
+// RangeGCS is a GCS that can also read byte ranges of objects, which allows
+// large objects to be downloaded in slices concurrently.
+type RangeGCS interface {
+	AttrsGCS
+
+	// NewRangeReader returns a reader for length bytes of the object,
+	// starting at offset. If generation is non-zero, the reader must serve
+	// exactly that generation of the object.
+	NewRangeReader(ctx context.Context, bucket, object string, generation, offset, length int64) (io.ReadCloser, error)
+}
+
+// objectAttrs returns the attributes of the object of job j, or nil if they
+// are not available.
+func (gf *Fetcher) objectAttrs(ctx context.Context, j job) *ObjectAttrs {
+	g, err := gf.backend(j.bucket)
+	if err != nil {
+		return nil
+	}
+	ag, ok := g.(AttrsGCS)
+	if !ok {
+		return nil
+	}
+	attrs, err := ag.Attrs(ctx, j.bucket, j.object, j.generation)
+	if err != nil {
+		gf.log("Failed to get attributes of %s, continuing: %v", formatGCSName(j.bucket, j.object, j.generation), err)
+		return nil
+	}
+	return attrs
+}
+
+// fetchAttrs gets the attributes of the object of job j within timeout, if
+// its backend has them. It reads the generation whose checksums are
+// verified, even if the object is overwritten meanwhile. Failures that
+// another attempt cannot fix, such as denied access to the metadata, leave j
+// without attributes and are only logged for the first object; the others
+// are returned, for the attempt to be retried.
+func (gf *Fetcher) fetchAttrs(ctx context.Context, j *job, timeout time.Duration) error {
+	g, err := gf.backend(j.bucket)
+	if err != nil {
+		return nil // Reported by the download.
+	}
+	ag, ok := g.(AttrsGCS)
+	if !ok {
+		return nil
+	}
+	actx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	attrs, err := ag.Attrs(actx, j.bucket, j.object, j.generation)
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case actx.Err() != nil:
+		return errGCSTimeout
+	case classify(err) == permanentError:
+		gf.attrsWarning.Do(func() {
+			gf.log("Failed to get attributes of %s, continuing without them for it and any other object they are denied for: %v", formatGCSName(j.bucket, j.object, j.generation), err)
+		})
+		return nil
+	default:
+		return fmt.Errorf("getting attributes of %q: %w", formatGCSName(j.bucket, j.object, j.generation), err)
+	}
+	j.attrs = attrs
+	if j.generation == 0 {
+		j.generation = attrs.Generation
+	}
+	if j.size == 0 {
+		j.size = attrs.Size
+	}
+	return nil
+}
+
+// sliced reports whether the object of job j with the given attributes
+// should be downloaded in slices.
+func (gf *Fetcher) sliced(j job, attrs *ObjectAttrs) bool {
+	if g, err := gf.backend(j.bucket); err != nil {
+		return false
+	} else if _, ok := g.(RangeGCS); !ok {
+		return false
+	}
+	return attrs != nil && gf.SliceThreshold > 0 && attrs.Size >= gf.SliceThreshold
+}
+
+// slices splits the download of job j into jobs for up to gf.WorkerCount
+// slices of at least minSliceSize bytes each, which are written to file.
+// Every slice is pinned to the given generation, so that all of them are
+// read from the same version of the object.
+func (gf *Fetcher) slices(j job, file string, size, generation int64) []job {
+	count := int64(gf.WorkerCount)
+	if count < 1 {
+		count = 1
+	}
+	sliceSize := (size + count - 1) / count
+	if sliceSize < minSliceSize {
+		sliceSize = minSliceSize
+	}
+
+	var jobs []job
+	for offset := int64(0); offset < size; offset += sliceSize {
+		s := j
+		s.generation = generation
+		s.sliceOf = file
+		s.offset = offset
+		s.length = sliceSize
+		if offset+sliceSize > size {
+			s.length = size - offset
+		}
+		s.size = s.length
+		// Only the assembled file can be verified.
+		s.sha1sum, s.sha256sum, s.attrs = "", "", nil
+		jobs = append(jobs, s)
+	}
+	return jobs
+}
+
+// fetchSliced downloads the object of job j with the given attributes in
+// slices, using the worker pool to fetch them concurrently. The slices are
+// written in place into a single temp file, whose checksums are verified
+// against the object's before it is renamed to its final location.
+// Each slice is retried on its own; the download fails if any slice fails.
+func (gf *Fetcher) fetchSliced(ctx context.Context, j job, attrs *ObjectAttrs) *jobReport {
+	j.attrs = attrs
+	report := &jobReport{job: j, started: time.Now()}
+	defer func() {
+		report.completed = time.Now()
+	}()
+	started := time.Now()
+
+	dest := gf.DestDir
+	if j.destDirOverride != "" {
+		dest = j.destDirOverride
+	}
+	finalname := filepath.Join(dest, j.filename)
+	size, err := gf.fetchSlicesOnce(ctx, j, attrs, finalname)
+	if err != nil {
+		gf.recordFailure(j, started, noTimeout, err, report)
+		return report
+	}
+	gf.recordSuccess(j, started, size, finalname, report)
+	return report
+}
+
+// fetchSlicesOnce does the work of fetchSliced, assembling the object in
+// finalname. It returns the number of bytes downloaded.
+func (gf *Fetcher) fetchSlicesOnce(ctx context.Context, j job, attrs *ObjectAttrs, finalname string) (_ sizeBytes, err error) {
+	tmpfile := filepath.Join(gf.StagingDir, fmt.Sprintf("%s-%s-%d-sliced", j.bucket, j.object, attrs.Generation))
+	if err := gf.ensureFolders(tmpfile); err != nil {
+		return 0, fmt.Errorf("creating folders for temp file %q: %v", tmpfile, err)
+	}
+	f, err := gf.OS.Create(tmpfile)
+	if err != nil {
+		return 0, fmt.Errorf("creating temp file %q: %v", tmpfile, err)
+	}
+	defer func() {
+		// Do not leave a temp file as large as the object behind.
+		if err != nil {
+			gf.OS.RemoveAll(tmpfile)
+		}
+	}()
+	err = f.Truncate(attrs.Size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("allocating %d bytes for temp file %q: %v", attrs.Size, tmpfile, err)
+	}
+
+	slices := gf.slices(j, tmpfile, attrs.Size, attrs.Generation)
+	stats := gf.processJobs(ctx, slices)
+	if !stats.success {
+		return 0, fmt.Errorf("fetching %d slices of %s: %w", len(slices), formatGCSName(j.bucket, j.object, attrs.Generation), &FetchError{Errs: stats.errs})
+	}
+	gf.log("Fetched %s in %d slices with %d workers (%d retries).", formatGCSName(j.bucket, j.object, attrs.Generation), len(slices), stats.workers, stats.retries)
+
+	// The slices were checked individually for their length only, so verify
+	// the assembled file as a whole.
+	r, err := gf.OS.Open(tmpfile)
+	if err != nil {
+		return 0, fmt.Errorf("opening temp file %q: %v", tmpfile, err)
+	}
+	sums := newChecksums(j)
+	_, err = io.Copy(sums, r)
+	r.Close()
+	if err != nil {
+		return 0, fmt.Errorf("reading temp file %q: %v", tmpfile, err)
+	}
+	if err := sums.verify(); err != nil {
+		return 0, err
+	}
+
+	if err := gf.ensureFolders(finalname); err != nil {
+		return 0, fmt.Errorf("creating folders for final file %q: %v", finalname, err)
+	}
+	if err := gf.OS.Rename(tmpfile, finalname); err != nil {
+		return 0, fmt.Errorf("renaming %q to %q: %v", tmpfile, finalname, err)
+	}
+	mode := j.fileMode()
+	if err := gf.OS.Chmod(finalname, mode); err != nil {
+		return 0, fmt.Errorf("chmod %q to %v: %v", finalname, mode, err)
+	}
+	return stats.size, nil
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRangeGCS adds ranged reads to fakeGCS. The first read of the slice at
+// failOffset fails.
+type fakeRangeGCS struct {
+	*fakeGCS
+	failOffset int64
+	badCRC     bool
+
+	mu     sync.Mutex
+	ranges []int64 // Offsets of the ranged reads.
+}
+
+func (f *fakeRangeGCS) Attrs(ctx context.Context, bucket, object string, gen int64) (*ObjectAttrs, error) {
+	content := f.objects[formatGCSName(bucket, object, generation)].content
+	crc := crc32.Checksum(content, crc32cTable)
+	if f.badCRC {
+		crc++
+	}
+	return &ObjectAttrs{Size: int64(len(content)), Generation: generation, CRC32C: crc}, nil
+}
+
+func (f *fakeRangeGCS) NewRangeReader(ctx context.Context, bucket, object string, gen, offset, length int64) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	first := true
+	for _, o := range f.ranges {
+		if o == offset {
+			first = false
+		}
+	}
+	f.ranges = append(f.ranges, offset)
+	if first && offset == f.failOffset {
+		return ioutil.NopCloser(fakeGCSErrorReader{err: errGCSRead}), nil
+	}
+	content := f.objects[formatGCSName(bucket, object, generation)].content
+	return ioutil.NopCloser(bytes.NewReader(content[offset : offset+length])), nil
+}
+
+func TestSlices(t *testing.T) {
+	defer func(size int64) { minSliceSize = size }(minSliceSize)
+	minSliceSize = 10
+
+	for _, c := range []struct {
+		size, workers int
+		want          []int64 // Lengths of the slices.
+	}{
+		{size: 100, workers: 4, want: []int64{25, 25, 25, 25}},
+		{size: 101, workers: 4, want: []int64{26, 26, 26, 23}},
+		{size: 100, workers: 20, want: []int64{10, 10, 10, 10, 10, 10, 10, 10, 10, 10}},
+		{size: 5, workers: 4, want: []int64{5}},
+	} {
+		gf := &Fetcher{WorkerCount: c.workers}
+		slices := gf.slices(job{filename: "f"}, "tmp", int64(c.size), generation)
+		var got []int64
+		var next int64
+		for _, s := range slices {
+			if s.offset != next || s.sliceOf != "tmp" || s.generation != generation {
+				t.Errorf("slices(%d) with %d workers got slice %+v at %d", c.size, c.workers, s, next)
+			}
+			next += s.length
+			got = append(got, s.length)
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("slices(%d) with %d workers got lengths %v, want %v", c.size, c.workers, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("slices(%d) with %d workers got lengths %v, want %v", c.size, c.workers, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFetchSliced(t *testing.T) {
+	defer func(size int64) { minSliceSize = size }(minSliceSize)
+	minSliceSize = 100
+
+	content := []byte(strings.Repeat("0123456789", 105))
+	for _, c := range []struct {
+		name        string
+		badCRC      bool
+		wantSuccess bool
+	}{
+		{"success", false, true},
+		{"checksum mismatch", true, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tc, teardown := buildTestContext(t)
+			defer teardown()
+
+			tc.gcs.objects[formatGCSName(successBucket, "big.tar", generation)] = fakeGCSResponse{content: content}
+			gcs := &fakeRangeGCS{fakeGCS: tc.gcs, failOffset: -1, badCRC: c.badCRC}
+			tc.gf.GCS = gcs
+			tc.gf.WorkerCount = 4
+			tc.gf.SliceThreshold = 1
+
+			j := job{filename: "big.tar", bucket: successBucket, object: "big.tar", destDirOverride: tc.gf.StagingDir}
+			attrs := tc.gf.objectAttrs(context.Background(), j)
+			if !tc.gf.sliced(j, attrs) {
+				t.Fatalf("sliced(%+v) got false, want true", attrs)
+			}
+			report := tc.gf.fetchSliced(context.Background(), j, attrs)
+			if report.success != c.wantSuccess {
+				t.Fatalf("fetchSliced() got success %v, want %v (err %v)", report.success, c.wantSuccess, report.err)
+			}
+			if !c.wantSuccess {
+				if !strings.Contains(report.err.Error(), "CRC32C mismatch") {
+					t.Errorf("fetchSliced() got err %v, want CRC32C mismatch", report.err)
+				}
+				return
+			}
+
+			// 1050 bytes in slices of 263, 263, 263 and 261 bytes.
+			if got, want := len(gcs.ranges), 4; got != want {
+				t.Errorf("fetchSliced() got %d ranged reads, want %d", got, want)
+			}
+			if int(report.size) != len(content) {
+				t.Errorf("fetchSliced() got size %d, want %d", report.size, len(content))
+			}
+			name := filepath.Join(tc.gf.StagingDir, "big.tar")
+			if b, err := ioutil.ReadFile(name); err != nil || !bytes.Equal(b, content) {
+				t.Errorf("ReadFile(%s) got (%q, %v), want (%q, nil)", name, b, err, content)
+			}
+		})
+	}
+}
+
+func TestFetchSlicedRetriesSlices(t *testing.T) {
+	defer func(size int64) { minSliceSize = size }(minSliceSize)
+	minSliceSize = 100
+
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	content := []byte(strings.Repeat("0123456789", 100))
+	tc.gcs.objects[formatGCSName(successBucket, "big.tar", generation)] = fakeGCSResponse{content: content}
+	gcs := &fakeRangeGCS{fakeGCS: tc.gcs, failOffset: 500}
+	tc.gf.GCS = gcs
+	tc.gf.WorkerCount = 4
+
+	j := job{filename: "big.tar", bucket: successBucket, object: "big.tar", destDirOverride: tc.gf.StagingDir}
+	attrs, _ := gcs.Attrs(context.Background(), successBucket, "big.tar", 0)
+	report := tc.gf.fetchSliced(context.Background(), j, attrs)
+	if !report.success {
+		t.Fatalf("fetchSliced() got err %v, want success", report.err)
+	}
+	// Four slices of 250 bytes, the one at 500 is read twice.
+	if got, want := len(gcs.ranges), 5; got != want {
+		t.Errorf("fetchSliced() got %d ranged reads, want %d", got, want)
+	}
+	name := filepath.Join(tc.gf.StagingDir, "big.tar")
+	if b, err := ioutil.ReadFile(name); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("ReadFile(%s) got (%q, %v), want (%q, nil)", name, b, err, content)
+	}
+}
+
+func TestFetchSlicedRemovesTempFile(t *testing.T) {
+	defer func(size int64) { minSliceSize = size }(minSliceSize)
+	minSliceSize = 100
+
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	content := []byte(strings.Repeat("0123456789", 100))
+	tc.gcs.objects[formatGCSName(successBucket, "big.tar", generation)] = fakeGCSResponse{content: content}
+	gcs := &fakeRangeGCS{fakeGCS: tc.gcs, failOffset: 500}
+	tc.gf.GCS = gcs
+	tc.gf.WorkerCount = 4
+	tc.gf.Retries = 0
+
+	j := job{filename: "big.tar", bucket: successBucket, object: "big.tar"}
+	attrs, _ := gcs.Attrs(context.Background(), successBucket, "big.tar", 0)
+	if report := tc.gf.fetchSliced(context.Background(), j, attrs); report.success {
+		t.Fatalf("fetchSliced() got success, want the failed slice to fail it")
+	}
+	if files := stagedFiles(t, tc.gf); len(files) != 0 {
+		t.Errorf("fetchSliced() left %v in the staging dir, want none", files)
+	}
+}
+
+func TestFetchFromArchiveSliced(t *testing.T) {
+	defer func(size int64) { minSliceSize = size }(minSliceSize)
+	minSliceSize = 16
+
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	object := "source.tar.gz"
+	tc.gcs.objects[formatGCSName(successBucket, object, generation)] = fakeGCSResponse{content: buildArchive(t, "TarGzArchive")}
+	gcs := &fakeRangeGCS{fakeGCS: tc.gcs, failOffset: -1}
+	tc.gf.GCS = gcs
+	tc.gf.Object = object
+	tc.gf.SourceType = "Auto"
+	tc.gf.SliceThreshold = 1
+	tc.gf.Stream = true
+
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() got %v, want nil", err)
+	}
+	if len(gcs.ranges) < 2 {
+		t.Errorf("Fetch() got %d ranged reads, want a sliced download", len(gcs.ranges))
+	}
+	name := filepath.Join(tc.gf.DestDir, "dir/file.txt")
+	if b, err := ioutil.ReadFile(name); err != nil || string(b) != archivedContent {
+		t.Errorf("ReadFile(%s) got (%q, %v), want (%q, nil)", name, b, err, archivedContent)
+	}
+}
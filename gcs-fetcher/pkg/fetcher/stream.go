@@ -0,0 +1,168 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// streamReader reads an archive from GCS for streaming extraction. It counts
+// the bytes read, remembers the first read failure so that failures of the
+// download can be told apart from failures of the extraction, and fails as
+// soon as ctx is done.
+type streamReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	if err := s.ctx.Err(); err != nil {
+		if s.err == nil {
+			s.err = err
+		}
+		return 0, err
+	}
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if err != nil && err != io.EOF && s.err == nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// streamArchive downloads the tar-based archive of job j and extracts it into
+// the destination directory while it is being downloaded, without staging it
+// on disk. sourceType is the format of the archive, or "Auto" to detect it
+// from the start of the stream.
+//
+// Like fetchObject, failed downloads are retried with backoff and the usual
+// GCS timeouts. A broken stream cannot be resumed, so every retry first
+// removes whatever the failed attempt extracted and then starts over. Failures
+// of the extraction itself, such as a corrupt archive or an exceeded limit,
+// are not retried.
+//
+// It returns the report of the download, the extractor that was used by the
+// successful attempt, and the archive type. Zip archives cannot be extracted
+// from a stream; if Auto detects one, streamArchive returns a nil report and
+// "ZipArchive" so that the caller can fall back to staging the archive.
+func (gf *Fetcher) streamArchive(ctx context.Context, j job, sourceType string) (*jobReport, *extractor, string) {
+	j.transfer = gf.progress.start(j)
+	report := &jobReport{job: j, started: time.Now()}
+	defer func() {
+		report.completed = time.Now()
+		gf.progress.finish(j.transfer, report)
+	}()
+
+	for retrynum := 0; retrynum <= gf.Retries; retrynum++ {
+		// Apply appropriate retry backoff.
+		if retrynum > 0 {
+			sleep(ctx, gf.retryBackoff(retrynum, report.attempts[len(report.attempts)-1].class))
+		}
+
+		started := time.Now()
+		allowedGCSTimeout := gf.timeout(j, retrynum)
+		x := gf.newExtractor(0)
+		j.transfer.restart()
+		detected, src, err := gf.streamArchiveOnce(ctx, j, sourceType, allowedGCSTimeout, x)
+		if err == nil {
+			if detected == "ZipArchive" {
+				return nil, nil, detected
+			}
+			gf.recordSuccess(j, started, sizeBytes(src.n), gf.DestDir, report)
+			return report, x, detected
+		}
+
+		// Failures to download the archive are worth another attempt, failures
+		// to extract it are not.
+		retry := src == nil || src.err != nil || err == errGCSTimeout
+		if err != errGCSTimeout && src != nil && src.err != nil {
+			err = fmt.Errorf("streaming %q: %v", formatGCSName(j.bucket, j.object, j.generation), err)
+		}
+		if uerr := x.undo(); uerr != nil {
+			err = fmt.Errorf("%v; %v", err, uerr)
+			retry = false
+		}
+		gf.recordFailure(j, started, allowedGCSTimeout, err, report)
+		if !retry || !retryable(j, report.attempts[len(report.attempts)-1].class) {
+			break
+		}
+	}
+	timeoutExhausted(report)
+	return report, nil, sourceType
+}
+
+// streamArchiveOnce makes a single attempt to download and extract the
+// archive of job j within timeout, using extractor x. It returns the archive
+// type and the reader of the download, which is nil if the download could not
+// be started. Running out of time is reported as errGCSTimeout.
+func (gf *Fetcher) streamArchiveOnce(ctx context.Context, j job, sourceType string, timeout time.Duration, x *extractor) (_ string, _ *streamReader, err error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	defer func() {
+		if err != nil && parent.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+			err = errGCSTimeout
+		}
+	}()
+
+	r, err := gf.newReader(ctx, j)
+	if err != nil {
+		return sourceType, nil, err
+	}
+	defer r.Close()
+
+	sums := newChecksums(j)
+	src := &streamReader{ctx: ctx, r: io.TeeReader(gf.limits.reader(ctx, j.transfer.reader(r)), sums)}
+	x.compressed = func() int64 { return src.n }
+	br := bufio.NewReader(src)
+
+	if sourceType == "Auto" {
+		header, err := br.Peek(sniffLen)
+		if err != nil && err != io.EOF {
+			return sourceType, src, fmt.Errorf("reading archive %s: %v", j.filename, err)
+		}
+		if sourceType = sniffArchiveType(header); sourceType == "" {
+			return sourceType, src, fmt.Errorf("cannot detect the archive type of %s; specify it with -type", j.filename)
+		}
+		if sourceType == "ZipArchive" {
+			return sourceType, src, nil
+		}
+	}
+
+	tr, err := tarDecompressors[sourceType](br)
+	if err != nil {
+		return sourceType, src, fmt.Errorf("decompressing archive %s: %v", j.filename, err)
+	}
+	defer tr.Close()
+	if err := untar(tar.NewReader(tr), x); err != nil {
+		return sourceType, src, err
+	}
+
+	// Read the rest of the object, such as the padding after the end of the
+	// tar stream, so that the download is complete and its checksum verified.
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		return sourceType, src, fmt.Errorf("reading archive %s: %v", j.filename, err)
+	}
+	return sourceType, src, sums.verify()
+}
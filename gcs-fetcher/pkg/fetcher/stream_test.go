@@ -0,0 +1,162 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// brokenStreamGCS serves content, but breaks the stream halfway through for
+// the first failures readers.
+type brokenStreamGCS struct {
+	content  []byte
+	failures int
+	readers  int
+}
+
+func (f *brokenStreamGCS) NewReader(ctx context.Context, bucket, object string, generation int64) (io.ReadCloser, error) {
+	f.readers++
+	if f.readers <= f.failures {
+		half := bytes.NewReader(f.content[:len(f.content)/2])
+		return ioutil.NopCloser(io.MultiReader(half, fakeGCSErrorReader{err: errGCSRead})), nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+var streamTarEntries = []tarEntry{
+	{header: tar.Header{Name: "first/", Typeflag: tar.TypeDir, Mode: 0755}},
+	{header: tar.Header{Name: "first/a.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: strings.Repeat("a", 4096)},
+	{header: tar.Header{Name: "keep.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: "from archive"},
+	{header: tar.Header{Name: "second/b.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: strings.Repeat("b", 4096)},
+}
+
+// listFiles returns the paths of everything below dir.
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir {
+			rel, _ := filepath.Rel(dir, path)
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walking %s: %v", dir, err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestStreamArchive(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		failures     int
+		wantSuccess  bool
+		wantAttempts int
+		wantFiles    []string
+	}{
+		{"no failures", 0, true, 1, []string{"existing.txt", "first", "first/a.txt", "keep.txt", "second", "second/b.txt"}},
+		{"broken stream is restarted", 2, true, 3, []string{"existing.txt", "first", "first/a.txt", "keep.txt", "second", "second/b.txt"}},
+		{"broken stream is cleaned up", maxretries + 1, false, maxretries + 1, []string{"existing.txt"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tc, teardown := buildTestContext(t)
+			defer teardown()
+
+			gcs := &brokenStreamGCS{content: buildTar(t, streamTarEntries).Bytes(), failures: c.failures}
+			tc.gf.GCS = gcs
+
+			// Files that were there before must survive a failed extraction.
+			existing := filepath.Join(tc.gf.DestDir, "existing.txt")
+			if err := ioutil.WriteFile(existing, []byte("existing"), 0644); err != nil {
+				t.Fatalf("WriteFile(%s): %v", existing, err)
+			}
+
+			j := job{filename: "source.tar", bucket: successBucket, object: "source.tar"}
+			report, x, sourceType := tc.gf.streamArchive(context.Background(), j, "Auto")
+			if report == nil {
+				t.Fatalf("streamArchive() got nil report, want non-nil")
+			}
+			if report.success != c.wantSuccess {
+				t.Errorf("streamArchive() got success %v, want %v (err %v)", report.success, c.wantSuccess, report.err)
+			}
+			if got := len(report.attempts); got != c.wantAttempts {
+				t.Errorf("streamArchive() got %d attempts, want %d", got, c.wantAttempts)
+			}
+			if c.wantSuccess {
+				if sourceType != "TarArchive" {
+					t.Errorf("streamArchive() got type %q, want %q", sourceType, "TarArchive")
+				}
+				if x == nil || x.numFiles != 3 {
+					t.Errorf("streamArchive() got extractor %+v, want 3 files", x)
+				}
+				if got := int(report.size); got != len(gcs.content) {
+					t.Errorf("streamArchive() got size %d, want %d", got, len(gcs.content))
+				}
+			}
+			if got := listFiles(t, tc.gf.DestDir); strings.Join(got, ",") != strings.Join(c.wantFiles, ",") {
+				t.Errorf("files after streamArchive() got %v, want %v", got, c.wantFiles)
+			}
+		})
+	}
+}
+
+func TestStreamArchiveDoesNotRetryExtractionFailures(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	gcs := &brokenStreamGCS{content: buildTar(t, streamTarEntries).Bytes()}
+	tc.gf.GCS = gcs
+	tc.gf.MaxExtractEntries = 2
+
+	j := job{filename: "source.tar", bucket: successBucket, object: "source.tar"}
+	report, _, _ := tc.gf.streamArchive(context.Background(), j, "TarArchive")
+	if report.success || !strings.Contains(report.err.Error(), "more than 2 entries") {
+		t.Errorf("streamArchive() got (%v, %v), want error containing %q", report.success, report.err, "more than 2 entries")
+	}
+	if got := len(report.attempts); got != 1 {
+		t.Errorf("streamArchive() got %d attempts, want 1", got)
+	}
+	if got := listFiles(t, tc.gf.DestDir); len(got) != 0 {
+		t.Errorf("files after streamArchive() got %v, want none", got)
+	}
+}
+
+func TestStreamArchiveZipFallsBack(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	tc.gf.GCS = &brokenStreamGCS{content: buildArchive(t, "ZipArchive")}
+
+	j := job{filename: "source.zip", bucket: successBucket, object: "source.zip"}
+	report, x, sourceType := tc.gf.streamArchive(context.Background(), j, "Auto")
+	if report != nil || x != nil || sourceType != "ZipArchive" {
+		t.Errorf("streamArchive() got (%v, %v, %q), want (nil, nil, %q)", report, x, sourceType, "ZipArchive")
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// latencyTimeout is the time allowed for a download of known size to get
+	// going, on top of the time its bytes should take to transfer.
+	latencyTimeout = map[int]time.Duration{ // try number -> timeout duration
+		0: 1 * time.Second,
+		1: 2 * time.Second,
+	}
+
+	// transferSlack is the factor by which a download of known size may be
+	// slower than the expected throughput before it times out.
+	transferSlack = map[int]float64{ // try number -> slack
+		0: 4,
+		1: 8,
+	}
+
+	// assumedThroughput is the throughput of a single download, in bytes per
+	// second, that is assumed before any download has completed. Observed
+	// downloads are weighted against it as if it had been observed for
+	// assumedThroughputWeight.
+	assumedThroughput       = float64(4 << 20)
+	assumedThroughputWeight = 1 * time.Second
+
+	// minThroughputSample is the size of the smallest download that is
+	// observed for the throughput. The time of smaller downloads is mostly
+	// latency, which would make large files time out early.
+	minThroughputSample = sizeBytes(1 << 20)
+)
+
+// throughput estimates the throughput of a single download from the bytes
+// and time of the downloads of at least minThroughputSample bytes that
+// completed so far.
+type throughput struct {
+	mu       sync.Mutex
+	size     sizeBytes
+	duration time.Duration
+}
+
+// add records a download of size bytes that took duration.
+func (t *throughput) add(size sizeBytes, duration time.Duration) {
+	if size < minThroughputSample {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.size += size
+	t.duration += duration
+}
+
+// rate returns the estimated throughput in bytes per second.
+func (t *throughput) rate() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	weight := assumedThroughputWeight.Seconds()
+	return (assumedThroughput*weight + float64(t.size)) / (weight + t.duration.Seconds())
+}
+
+// timeout returns the GCS timeout that should be used for job j on a given
+// retry number. GCS has long tails on occasion, so in some cases, it's faster
+// to give up early and retry on a second connection.
+//
+// If the size of the object is known, the first tries get the time its bytes
+// should take at the throughput observed so far, with some slack, plus an
+// allowance for latency. Otherwise, short timeouts are used for source code
+// and longer ones for everything else. With a bandwidth limit, the expected
+// throughput is at most the share of a single worker, and objects of unknown
+// size are not timed out early.
+func (gf *Fetcher) timeout(j job, retrynum int) time.Duration {
+	if gf.TimeoutGCS == false {
+		return defaultTimeout
+	}
+
+	if j.size > 0 {
+		latency, ok := latencyTimeout[retrynum]
+		if !ok {
+			return defaultTimeout
+		}
+		rate := gf.throughput.rate()
+		if gf.MaxBytesPerSecond > 0 && gf.WorkerCount > 0 {
+			if share := float64(gf.MaxBytesPerSecond) / float64(gf.WorkerCount); share < rate {
+				rate = share
+			}
+		}
+		transfer := float64(j.size) / rate * transferSlack[retrynum]
+		if transfer > defaultTimeout.Seconds() {
+			return defaultTimeout
+		}
+		timeout := latency + time.Duration(transfer*float64(time.Second))
+		if timeout > defaultTimeout {
+			return defaultTimeout
+		}
+		return timeout
+	}
+
+	if gf.MaxBytesPerSecond > 0 {
+		return defaultTimeout
+	}
+
+	// Use short timeouts for source code, longer for non-source
+	if sourceExt[filepath.Ext(j.filename)] {
+		if timeout, ok := sourceTimeout[retrynum]; ok {
+			return timeout
+		}
+	} else {
+		if timeout, ok := notSourceTimeout[retrynum]; ok {
+			return timeout
+		}
+	}
+	return defaultTimeout
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		filename string
+		retrynum int
+		want     time.Duration
+	}{
+		{"source.js", 0, sourceTimeout[0]},
+		{"source.js", 1, sourceTimeout[1]},
+		{"source.js", 2, defaultTimeout},
+		{"not-source.mpg", 0, notSourceTimeout[0]},
+		{"not-source.mpg", 1, notSourceTimeout[1]},
+		{"not-source.mpg", 2, defaultTimeout},
+		{"no-extension", 0, notSourceTimeout[0]},
+		{"no-extension", 1, notSourceTimeout[1]},
+		{"no-extension", 2, defaultTimeout},
+	}
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+	for _, test := range tests {
+		got := tc.gf.timeout(job{filename: test.filename}, test.retrynum)
+		if got != test.want {
+			t.Errorf("timeout(%v, %v) got %v, want %v", test.filename, test.retrynum, got, test.want)
+		}
+	}
+}
+
+func TestTimeoutScalesWithSize(t *testing.T) {
+	defer func(bps float64) { assumedThroughput = bps }(assumedThroughput)
+	assumedThroughput = 1 << 20
+
+	tests := []struct {
+		size     int64
+		retrynum int
+		want     time.Duration
+	}{
+		// 1 MiB at 1 MiB/s, with slack and latency allowance.
+		{1 << 20, 0, latencyTimeout[0] + 4*time.Second},
+		{1 << 20, 1, latencyTimeout[1] + 8*time.Second},
+		{1 << 20, 2, defaultTimeout},
+		// A large file no longer gets the short timeout of its extension.
+		{200 << 20, 0, latencyTimeout[0] + 800*time.Second},
+		// A tiny file gets less than the timeout of its extension.
+		{1 << 10, 0, latencyTimeout[0] + 4*time.Second/1024},
+		// Huge files are capped at the default timeout.
+		{1 << 40, 0, defaultTimeout},
+	}
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+	for _, test := range tests {
+		got := tc.gf.timeout(job{filename: "bundle.js", size: test.size}, test.retrynum)
+		if got != test.want {
+			t.Errorf("timeout(%d bytes, %v) got %v, want %v", test.size, test.retrynum, got, test.want)
+		}
+	}
+
+	// Small downloads, whose time is mostly latency, are not observed.
+	for i := 0; i < 100; i++ {
+		tc.gf.throughput.add(1<<10, time.Second)
+	}
+	if got, want := tc.gf.timeout(job{size: 200 << 20}, 0), latencyTimeout[0]+800*time.Second; got != want {
+		t.Errorf("timeout() after observing small downloads got %v, want %v", got, want)
+	}
+
+	// Downloads faster than assumed shorten the timeouts.
+	tc.gf.throughput.add(3<<20, time.Second)
+	if got, want := tc.gf.timeout(job{size: 2 << 20}, 0), latencyTimeout[0]+4*time.Second; got != want {
+		t.Errorf("timeout() after observing 3 MiB/s got %v, want %v", got, want)
+	}
+	tc.gf.TimeoutGCS = false
+	if got := tc.gf.timeout(job{size: 1 << 10}, 0); got != defaultTimeout {
+		t.Errorf("timeout() without TimeoutGCS got %v, want %v", got, defaultTimeout)
+	}
+}
+
+func TestFetchObjectSizeFromAttrs(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+	gcs := &attrsGCS{fakeGCS: tc.gcs}
+	tc.gf.GCS = gcs
+
+	// The entry has a checksum, but no size to derive timeouts from, which is
+	// not worth an extra request.
+	j := job{filename: sfile1, bucket: successBucket, object: sfile1, sha1sum: fmt.Sprintf("%x", sha1.Sum(sfile1Contents))}
+	report := tc.gf.fetchObject(context.Background(), j)
+	if !report.success || gcs.calls != 0 {
+		t.Fatalf("fetchObject() with a SHA-1 got %d attribute requests (%v), want 0", gcs.calls, report.err)
+	}
+
+	// Without a checksum, the attributes are read anyway.
+	j.sha1sum = ""
+	report = tc.gf.fetchObject(context.Background(), j)
+	if !report.success || gcs.calls != 1 {
+		t.Fatalf("fetchObject() without a checksum got %d attribute requests (%v), want 1", gcs.calls, report.err)
+	}
+	if got, want := report.job.size, int64(len(sfile1Contents)); got != want {
+		t.Errorf("fetchObject() got size %d, want %d from the attributes", got, want)
+	}
+}
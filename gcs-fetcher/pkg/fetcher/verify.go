@@ -0,0 +1,240 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fileState is the outcome of verifying a single manifest entry.
+type fileState int
+
+const (
+	// fileVerified matches the manifest, including its checksum.
+	fileVerified fileState = iota
+	// fileUnverified matches the manifest as far as it is known, but the
+	// manifest has no checksum to verify its contents against.
+	fileUnverified
+	fileMissing
+	fileModified
+	fileWrongMode
+)
+
+// verifyFile compares the file of job j in gf.DestDir against the manifest.
+func (gf *Fetcher) verifyFile(j job) (fileState, error) {
+	name := filepath.Join(gf.DestDir, j.filename)
+	fi, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return fileMissing, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() || (j.size > 0 && fi.Size() != j.size) {
+		return fileModified, nil
+	}
+
+	state := fileUnverified
+	if j.sha1sum != "" || j.sha256sum != "" {
+		f, err := os.Open(name)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		sums := newChecksums(j)
+		if _, err := io.Copy(sums, f); err != nil {
+			return 0, fmt.Errorf("reading %s: %v", name, err)
+		}
+		if sums.verify() != nil {
+			return fileModified, nil
+		}
+		state = fileVerified
+	} else if gf.RequireChecksums {
+		return 0, &UnverifiableError{JobInfo: j.info()}
+	}
+
+	if fi.Mode()&restorableModeBits != j.fileMode() {
+		return fileWrongMode, nil
+	}
+	return state, nil
+}
+
+// extraFiles returns the files in gf.DestDir that are selected by gf.filter
+// but not listed in the manifest, except for the staging and cache
+// directories.
+func (gf *Fetcher) extraFiles(jobs []job) ([]string, error) {
+	listed := make(map[string]bool, len(jobs))
+	for _, j := range jobs {
+		listed[filepath.Clean(j.filename)] = true
+	}
+	skip := map[string]bool{filepath.Clean(gf.StagingDir): true}
+	if gf.CacheDir != "" {
+		skip[filepath.Clean(gf.CacheDir)] = true
+	}
+
+	var extra []string
+	err := filepath.Walk(gf.DestDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == gf.DestDir && os.IsNotExist(err) {
+				// Every file will be reported missing.
+				return nil
+			}
+			return err
+		}
+		if skip[filepath.Clean(path)] {
+			return filepath.SkipDir
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(gf.DestDir, path)
+		if err != nil {
+			return err
+		}
+		if !listed[rel] && gf.filter.match(filepath.ToSlash(rel)) {
+			extra = append(extra, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return extra, err
+}
+
+// verifyManifest is used instead of fetchFromManifest to verify the files in
+// gf.DestDir against the manifest without fetching them. It returns a
+// DriftError if any file is missing, extra, modified or has the wrong mode.
+func (gf *Fetcher) verifyManifest(ctx context.Context) error {
+	started := time.Now()
+	rep := gf.newReport(started)
+	jobs, filtered, report, err := gf.loadManifest(ctx)
+	if err != nil {
+		return err
+	}
+	// The manifest has been decoded, and must not be taken for an extra file.
+	if err := gf.removeStagingDir(); err != nil {
+		gf.log("Failed to remove staging dir %v, continuing: %v", gf.StagingDir, err)
+	}
+
+	if gf.filter != nil {
+		gf.log("Verifying %v files in %s, %v were filtered out.", len(jobs), gf.DestDir, filtered)
+	} else {
+		gf.log("Verifying %v files in %s.", len(jobs), gf.DestDir)
+	}
+
+	// Hash the files in parallel.
+	states := make([]fileState, len(jobs))
+	errs := make([]error, len(jobs))
+	workers := gf.WorkerCount
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	todo := make(chan int, len(jobs))
+	for i := range jobs {
+		todo <- i
+	}
+	close(todo)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				if errs[i] = ctx.Err(); errs[i] == nil {
+					states[i], errs[i] = gf.verifyFile(jobs[i])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	drift := &DriftError{}
+	var failures []error
+	verified := 0
+	for i, j := range jobs {
+		if errs[i] != nil {
+			failures = append(failures, fmt.Errorf("verifying %s: %w", j.filename, errs[i]))
+			continue
+		}
+		switch states[i] {
+		case fileVerified:
+			verified++
+		case fileMissing:
+			drift.Missing = append(drift.Missing, j.filename)
+		case fileModified:
+			drift.Modified = append(drift.Modified, j.filename)
+		case fileWrongMode:
+			drift.WrongMode = append(drift.WrongMode, j.filename)
+		}
+	}
+	if drift.Extra, err = gf.extraFiles(jobs); err != nil {
+		failures = append(failures, fmt.Errorf("listing %s: %v", gf.DestDir, err))
+	}
+	for _, paths := range [][]string{drift.Missing, drift.Extra, drift.Modified, drift.WrongMode} {
+		sort.Strings(paths)
+	}
+
+	rep.Drift = drift
+	rep.Totals.Workers = workers
+	rep.Totals.Files = len(jobs)
+	rep.Totals.FilteredFiles = filtered
+	rep.Totals.VerifiedFiles = verified
+
+	// Emit final stats.
+	manifestDuration := report.attempts[len(report.attempts)-1].duration
+	status := "SUCCESS"
+	if len(failures) > 0 || !drift.empty() {
+		status = "FAILURE"
+	}
+	gf.log("******************************************************")
+	gf.log("Status:                      %s", status)
+	gf.log("Started:                     %s", started.Format(time.RFC3339))
+	gf.log("Completed:                   %s", time.Now().Format(time.RFC3339))
+	gf.log("Total files:       %6d", len(jobs))
+	gf.log("Verified files:    %6d", verified)
+	gf.log("Missing files:     %6d", len(drift.Missing))
+	gf.log("Extra files:       %6d", len(drift.Extra))
+	gf.log("Modified files:    %6d", len(drift.Modified))
+	gf.log("Wrong mode files:  %6d", len(drift.WrongMode))
+	if len(failures) > 0 {
+		gf.log("Errors:            %6d", len(failures))
+	}
+	if gf.filter != nil {
+		gf.log("Filtered files:    %6d", filtered)
+	}
+	gf.log("Time for manifest: %9.2f ms", float64(manifestDuration)/float64(time.Millisecond))
+	gf.log("Total time:        %9.2f s", time.Since(started).Seconds())
+	gf.log("******************************************************")
+
+	if len(failures) > 0 {
+		if !drift.empty() {
+			failures = append(failures, drift)
+		}
+		return &FetchError{Errs: failures}
+	}
+	if !drift.empty() {
+		return drift
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const verifyManifest = "verify-manifest.json"
+
+// buildVerifyContext returns a test context whose destination was fetched
+// from verifyManifest, to be verified afterwards.
+func buildVerifyContext(t *testing.T) (*testContext, func()) {
+	t.Helper()
+	tc, teardown := buildTestContext(t)
+	tc.gcs.objects[formatGCSName(successBucket, verifyManifest, generation)] = fakeGCSResponse{content: []byte(fmt.Sprintf(`{
+		"a.js":      {"sourceUrl": "gs://success-bucket/sfile1.js#12345", "sha256": "%x"},
+		"dir/b.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg#12345", "sha256": "%x", "mode": 420},
+		"c":         {"sourceUrl": "gs://success-bucket/sfile3#12345", "sha256": "%x"},
+		"d":         {"sourceUrl": "gs://success-bucket/sfile1.js#12345", "sha256": "%x"},
+		"e":         {"sourceUrl": "gs://success-bucket/sfile3#12345"}
+	}`, sha256.Sum256(sfile1Contents), sha256.Sum256(sfile2Contents), sha256.Sum256(sfile3Contents), sha256.Sum256(sfile1Contents)))}
+	tc.gf.Object = verifyManifest
+	tc.gf.SourceType = "Manifest"
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		teardown()
+		t.Fatalf("Fetch() got %v, want nil", err)
+	}
+	tc.gf.Verify = true
+	return tc, teardown
+}
+
+func TestVerifyManifest(t *testing.T) {
+	tc, teardown := buildVerifyContext(t)
+	defer teardown()
+
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() with Verify got %v, want nil", err)
+	}
+	if _, err := os.Stat(tc.gf.StagingDir); !os.IsNotExist(err) {
+		t.Errorf("Fetch() with Verify left staging dir %s: %v", tc.gf.StagingDir, err)
+	}
+
+	dest := func(name string) string { return filepath.Join(tc.workDir, name) }
+	if err := os.Remove(dest("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dest("dir/extra.txt"), []byte("extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dest("a.js"), sfile2Contents, 0555); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dest("d"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := tc.gf.Fetch(context.Background())
+	var derr *DriftError
+	if !errors.As(err, &derr) {
+		t.Fatalf("Fetch() with Verify got %v, want DriftError", err)
+	}
+	want := &DriftError{
+		Missing:   []string{"c"},
+		Extra:     []string{"dir/extra.txt"},
+		Modified:  []string{"a.js"},
+		WrongMode: []string{"d"},
+	}
+	if !reflect.DeepEqual(derr, want) {
+		t.Errorf("Fetch() with Verify got %+v, want %+v", derr, want)
+	}
+	if !strings.Contains(err.Error(), "extra: dir/extra.txt") {
+		t.Errorf("Fetch() with Verify got error %q, want it to list dir/extra.txt", err)
+	}
+}
+
+func TestVerifyManifestFilters(t *testing.T) {
+	tc, teardown := buildVerifyContext(t)
+	defer teardown()
+
+	// Drift outside of the selected files is ignored.
+	if err := os.Remove(filepath.Join(tc.workDir, "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tc.workDir, "extra.txt"), []byte("extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tc.gf.Include = []string{"dir/**", "a.js"}
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Errorf("Fetch() with Verify got %v, want nil", err)
+	}
+
+	tc.gf.Include = nil
+	var derr *DriftError
+	if err := tc.gf.Fetch(context.Background()); !errors.As(err, &derr) || len(derr.Missing) != 1 || len(derr.Extra) != 1 {
+		t.Errorf("Fetch() with Verify got %v, want 1 missing and 1 extra file", err)
+	}
+}
+
+func TestVerifyManifestRequireChecksums(t *testing.T) {
+	tc, teardown := buildVerifyContext(t)
+	defer teardown()
+
+	tc.gf.RequireChecksums = true
+	// The manifest is verified against its attributes.
+	tc.gf.GCS = &attrsGCS{fakeGCS: tc.gcs}
+	err := tc.gf.Fetch(context.Background())
+	var uerr *UnverifiableError
+	if !errors.As(err, &uerr) || uerr.Object != sfile3 {
+		t.Errorf("Fetch() with Verify got %v, want UnverifiableError for %s", err, sfile3)
+	}
+}
+
+func TestVerifyRequiresManifest(t *testing.T) {
+	tc, teardown := buildTestContext(t)
+	defer teardown()
+
+	tc.gf.SourceType = "ZipArchive"
+	tc.gf.Verify = true
+	if err := tc.gf.Fetch(context.Background()); err == nil || !strings.Contains(err.Error(), "-verify") {
+		t.Errorf("Fetch() got %v, want error about -verify", err)
+	}
+}
@@ -16,15 +16,19 @@ limitations under the License.
 package uploader
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 
+	"cloud.google.com/go/storage"
 	"google.golang.org/api/googleapi"
 
 	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
@@ -49,7 +53,14 @@ type OS interface {
 
 // GCS allows us to inject dependencies to facilitate testing.
 type GCS interface {
-	NewWriter(ctx context.Context, bucket, object string) io.WriteCloser
+	NewWriter(ctx context.Context, bucket, object string) Writer
+}
+
+// Writer writes an object, as *storage.Writer does. Once it is closed, Attrs
+// returns the attributes of the object written, including its generation.
+type Writer interface {
+	io.WriteCloser
+	Attrs() *storage.ObjectAttrs
 }
 
 type job struct {
@@ -109,7 +120,8 @@ func (u *Uploader) Do(ctx context.Context, path string, info os.FileInfo) error
 	// Compute digest of file, and count bytes.
 	cw := &countWriter{}
 	h := sha1.New()
-	if _, err := io.Copy(io.MultiWriter(cw, h), f); err != nil {
+	h256 := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(cw, h, h256), f); err != nil {
 		return err
 	}
 	digest := fmt.Sprintf("%x", h.Sum(nil))
@@ -125,18 +137,29 @@ func (u *Uploader) Do(ctx context.Context, path string, info os.FileInfo) error
 		return err
 	}
 
-	u.manifest.Store(path, common.ManifestItem{
-		SourceURL: fmt.Sprintf("gs://%s/%s", u.bucket, digest),
-		Sha1Sum:   digest,
-		FileMode:  info.Mode(),
-	})
-
+	// Record the generation of the object we just wrote, so that the fetcher
+	// reads exactly these bytes even if the object is later overwritten. An
+	// object that already existed is named after the digest of its contents
+	// all the same, which the fetcher verifies.
+	sourceURL := fmt.Sprintf("gs://%s/%s", u.bucket, digest)
 	if err := wc.Close(); isAlreadyExists(err) {
 		u.bytesSkipped += cw.b
 	} else if err != nil {
-		return err
+		return describe(err, u.bucket, digest)
+	} else {
+		sourceURL = fmt.Sprintf("%s#%d", sourceURL, wc.Attrs().Generation)
 	}
 	u.totalBytes += cw.b
+
+	mtime := info.ModTime()
+	u.manifest.Store(path, common.ManifestItem{
+		SourceURL: sourceURL,
+		Sha1Sum:   digest,
+		Sha256Sum: fmt.Sprintf("%x", h256.Sum(nil)),
+		FileMode:  info.Mode(),
+		ModTime:   &mtime,
+		Size:      cw.b,
+	})
 	return nil
 }
 
@@ -156,6 +179,21 @@ func isAlreadyExists(err error) bool {
 	return false
 }
 
+// describe returns err, explaining it if GCS failed because the bucket is
+// requester-pays or the object is encrypted with a customer-supplied
+// encryption key, and the request did not have the right options for it.
+func describe(err error, bucket, object string) error {
+	switch {
+	case common.IsUserProjectMissing(err):
+		return fmt.Errorf("bucket %s is a requester-pays bucket; set --billing_project to the project to bill for writing gs://%s/%s: %w", bucket, bucket, object, err)
+	case common.IsEncryptionKeyMissing(err):
+		return fmt.Errorf("gs://%s/%s is encrypted with a customer-supplied encryption key; set --encryption_key_file to the file holding it: %w", bucket, object, err)
+	case common.IsEncryptionKeyIncorrect(err):
+		return fmt.Errorf("gs://%s/%s is encrypted with a different customer-supplied encryption key than the one of --encryption_key_file: %w", bucket, object, err)
+	}
+	return err
+}
+
 func (u *Uploader) writeManifest(ctx context.Context) error {
 	m := map[string]common.ManifestItem{}
 	u.manifest.Range(func(k, v interface{}) bool {
@@ -164,12 +202,23 @@ func (u *Uploader) writeManifest(ctx context.Context) error {
 	})
 
 	wc := u.gcs.NewWriter(ctx, u.bucket, u.manifestObject)
-	if err := json.NewEncoder(wc).Encode(m); err != nil {
+	// Manifests named *.gz are gzip compressed; gcs-fetcher detects them by
+	// their contents.
+	var w io.WriteCloser = wc
+	if strings.HasSuffix(u.manifestObject, ".gz") {
+		w = gzip.NewWriter(wc)
+	}
+	if err := json.NewEncoder(w).Encode(m); err != nil {
 		return err
 	}
+	if w != wc {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
 	if err := wc.Close(); err != nil {
-		return err
+		return describe(err, u.bucket, u.manifestObject)
 	}
-	fmt.Printf("Wrote manifest object gs://%s/%s", u.bucket, u.manifestObject)
+	fmt.Printf("Wrote manifest object gs://%s/%s#%d", u.bucket, u.manifestObject, wc.Attrs().Generation)
 	return nil
 }